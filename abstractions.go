@@ -17,17 +17,18 @@ type StreamStoreReader interface {
 	GetActiveStream() (*EventStream, error)
 	GetEventStream(string) (*EventStream, error)
 	GetAllEventStreams() ([]*EventStream, error)
+	FindEvent(string) (*nostr.Event, error)
 	// Misc
 	ListEventStreams(bool) error
 	GetPubForName(string) (string, error)
 }
 
 type StreamStoreWriter interface {
-	CreateEventStream(string, string, bool)
+	CreateEventStream(string, string, bool, *Derivation)
 	SaveEventStream(*EventStream) error
 	RemoveEventStream(string)
 	SetActiveEventStream(string) error
-	FollowEventStream(*Nostr, Timestamper, string, string) error
+	FollowEventStream(*Nostr, string, string, []string) error
 	UnfollowEventStream(string)
 }
 
@@ -49,7 +50,7 @@ type EventStreamReader interface {
 }
 
 type EventStreamWriter interface {
-	Create(string, Timestamper) (*nostr.Event, error)
+	Create(string, Signer, Timestamper) (*nostr.Event, error)
 	Append(nostr.Event, Timestamper) error
 	Sync(*Nostr, Timestamper) error
 	Mirror(*Nostr, string) error
@@ -57,13 +58,33 @@ type EventStreamWriter interface {
 	RemoveRelay(string) error
 }
 
+// Signer provides an interface for signing nostr events of a stream
+type Signer interface {
+	// Sets the id and the signature of the event
+	Sign(*nostr.Event) error
+}
+
 // Timestamper provides an interface for timestamping nostr events
 type Timestamper interface {
 	Stamp(*nostr.Event) (string, error)
+	// Stamps the events together, returns the stamp of every event
+	StampBatch([]*nostr.Event) ([]string, error)
 	IsUpgraded(*nostr.Event) bool
 	Upgrade(*nostr.Event) (*opentimestamps.Timestamp, error)
 	Verify(*nostr.Event) (bool, *time.Time, error)
-	HasRPCConfigured() bool
+	VerifyEvent(*nostr.Event) *OTSResult
+	// Whether the blocks come from somewhere we trust, i.e. not only from a public api
+	HasTrustedHeaders() bool
+	// How long after its attestation an event may claim to be created
+	AttestationSlack() time.Duration
+}
+
+// BlockHeaderSource provides the bitcoin block headers attestations are verified against
+type BlockHeaderSource interface {
+	Name() string
+	// Whether the headers come from a third party
+	IsRemote() bool
+	HeaderAt(height uint64) (*BlockHeader, error)
 }
 
 type BitcoinRPCManager interface {
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const AGENT_SOCKET = "agent.sock"
+const DEFAULT_AGENT_TTL = 15 * time.Minute
+
+// The agent holds unlocked private keys in memory and signs events with them so we don't
+// have to type the passphrase for every event. It listens on a unix socket in the data
+// directory that only the owner can connect to.
+type Agent struct {
+	mu   sync.Mutex
+	keys map[string]agentKey
+	ttl  time.Duration
+}
+
+type agentKey struct {
+	privkey string
+	expires time.Time
+}
+
+// Requests and responses are single json lines
+type AgentRequest struct {
+	// One of "add", "sign", "has", "lock"
+	Op      string       `json:"op"`
+	PubKey  string       `json:"pubkey,omitempty"`
+	PrivKey string       `json:"privkey,omitempty"`
+	TTL     int64        `json:"ttl,omitempty"` // seconds
+	Event   *nostr.Event `json:"event,omitempty"`
+}
+
+type AgentResponse struct {
+	OK    bool         `json:"ok"`
+	Error string       `json:"error,omitempty"`
+	Event *nostr.Event `json:"event,omitempty"`
+}
+
+func agentSocketPath(cfg *Config) string {
+	return filepath.Join(cfg.DataDir, AGENT_SOCKET)
+}
+
+// Runs the agent until it gets interrupted
+func runAgent(cfg *Config, ttl time.Duration) error {
+	path := agentSocketPath(cfg)
+	if (&AgentClient{path: path}).IsRunning() {
+		return errors.New("an agent is already running")
+	}
+	// Remove a socket left behind by an agent that didn't shut down cleanly
+	os.Remove(path)
+	l, err := listenAgent(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	a := &Agent{keys: map[string]agentKey{}, ttl: ttl}
+	cancel_chan := make(chan os.Signal, 1)
+	signal.Notify(cancel_chan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-cancel_chan
+		l.Close()
+	}()
+	// Forget expired keys even when nobody asks for them
+	go func() {
+		for range time.Tick(time.Minute) {
+			a.expire()
+		}
+	}()
+
+	fmt.Printf("Agent listening on %s. Keys are kept for %s.\n", path, ttl)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				fmt.Println("\nAgent stopped.")
+				return nil
+			}
+			log.Println(err.Error())
+			continue
+		}
+		go a.serve(conn)
+	}
+}
+
+func (a *Agent) serve(conn net.Conn) {
+	defer conn.Close()
+	if !isPeerOwner(conn) {
+		log.Println("refused an agent connection from another user")
+		return
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var req AgentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	resp := a.handle(req)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+func (a *Agent) handle(req AgentRequest) AgentResponse {
+	a.expire()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch req.Op {
+	case "add":
+		pubkey := getPubKey(req.PrivKey)
+		if pubkey == "" {
+			return AgentResponse{Error: "invalid private key"}
+		}
+		ttl := a.ttl
+		if req.TTL > 0 {
+			ttl = time.Duration(req.TTL) * time.Second
+		}
+		a.keys[pubkey] = agentKey{privkey: req.PrivKey, expires: time.Now().Add(ttl)}
+		return AgentResponse{OK: true}
+	case "has":
+		_, ok := a.keys[req.PubKey]
+		return AgentResponse{OK: ok}
+	case "sign":
+		key, ok := a.keys[req.PubKey]
+		if !ok {
+			return AgentResponse{Error: "the agent doesn't hold the key for " + req.PubKey}
+		}
+		if req.Event == nil || req.Event.PubKey != req.PubKey {
+			return AgentResponse{Error: "event pubkey doesn't match"}
+		}
+		ev := *req.Event
+		if err := ev.Sign(key.privkey); err != nil {
+			return AgentResponse{Error: err.Error()}
+		}
+		return AgentResponse{OK: true, Event: &ev}
+	case "lock":
+		a.keys = map[string]agentKey{}
+		return AgentResponse{OK: true}
+	}
+
+	return AgentResponse{Error: "unknown op: " + req.Op}
+}
+
+func (a *Agent) expire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for pubkey, key := range a.keys {
+		if now.After(key.expires) {
+			delete(a.keys, pubkey)
+		}
+	}
+}
+
+// Talks to a running agent
+type AgentClient struct {
+	path string
+}
+
+func (c *AgentClient) call(req AgentRequest) (*AgentResponse, error) {
+	conn, err := net.DialTimeout("unix", c.path, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("can't reach the agent: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp AgentResponse
+	if err = json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (c *AgentClient) IsRunning() bool {
+	_, err := c.call(AgentRequest{Op: "has"})
+	return err == nil
+}
+
+func (c *AgentClient) Has(pubkey string) bool {
+	resp, err := c.call(AgentRequest{Op: "has", PubKey: pubkey})
+	return err == nil && resp.OK
+}
+
+func (c *AgentClient) Add(priv_key string, ttl time.Duration) error {
+	resp, err := c.call(AgentRequest{Op: "add", PrivKey: priv_key, TTL: int64(ttl.Seconds())})
+	if err != nil {
+		return err
+	}
+	if !resp.OK {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func (c *AgentClient) Lock() error {
+	resp, err := c.call(AgentRequest{Op: "lock"})
+	if err != nil {
+		return err
+	}
+	if !resp.OK {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func (c *AgentClient) Sign(pubkey string, ev nostr.Event) (*nostr.Event, error) {
+	resp, err := c.call(AgentRequest{Op: "sign", PubKey: pubkey, Event: &ev})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.OK || resp.Event == nil {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Event, nil
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// Checks the process on the other end of the socket runs as the same user as the agent
+func isPeerOwner(conn net.Conn) bool {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var cred *syscall.Ucred
+	ctrl_err := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if ctrl_err != nil || err != nil {
+		return false
+	}
+	return int(cred.Uid) == os.Getuid()
+}
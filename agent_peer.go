@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// Peer credentials are only checked on linux, elsewhere the socket permissions keep other
+// users out
+func isPeerOwner(conn net.Conn) bool {
+	return true
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Creates the agent socket so that only the owner can connect to it. The umask is set around
+// the listen call so the socket never exists with looser permissions.
+func listenAgent(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// Windows has no umask, the socket gets the permissions of the data directory
+func listenAgent(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Block times are only roughly right, so an event may claim to be created a bit after the
+// block that attests it
+const DEFAULT_ATTESTATION_SLACK = 2 * time.Hour
+
+var ErrAttestationOrder = errors.New("attestations are out of order")
+
+// A break of the attestation order and the event it was found at
+type AttestationOrderError struct {
+	EventID string
+	msg     string
+}
+
+func (e *AttestationOrderError) Error() string {
+	return ErrAttestationOrder.Error() + ": " + e.msg
+}
+
+func (e *AttestationOrderError) Is(target error) bool {
+	return target == ErrAttestationOrder
+}
+
+// Checks the attested times along a chain of events:
+// 1. Attested times don't go back
+// 2. An event isn't created more than the slack after it was attested
+// 3. An event isn't attested more than the slack before the event it builds on was created
+// Pending events have no attested time yet. They pass and get checked once they're attested.
+type AttestationOrder struct {
+	slack time.Duration
+	// The latest attested time so far and its event
+	last    time.Time
+	last_id string
+	// The event the next one builds on
+	prev *nostr.Event
+	// Every break of the order found so far
+	violations []*AttestationOrderError
+}
+
+func newAttestationOrder(slack time.Duration) *AttestationOrder {
+	return &AttestationOrder{slack: slack}
+}
+
+// Checks the event that builds on the events checked so far
+func (o *AttestationOrder) Check(ev *nostr.Event, attested *time.Time) error {
+	prev := o.prev
+	o.prev = ev
+	if attested == nil {
+		return nil
+	}
+	if o.last_id != "" && attested.Before(o.last) {
+		return o.violation(ev, "%s attested at %s, before %s attested at %s",
+			showEventID(ev.ID), formatTime(*attested), showEventID(o.last_id), formatTime(o.last))
+	}
+	o.last, o.last_id = *attested, ev.ID
+	if ev.CreatedAt.After(attested.Add(o.slack)) {
+		return o.violation(ev, "%s created at %s, more than %s after it was attested at %s",
+			showEventID(ev.ID), formatTime(ev.CreatedAt), o.slack, formatTime(*attested))
+	}
+	if prev != nil && prev.CreatedAt.After(attested.Add(o.slack)) {
+		return o.violation(ev, "%s attested at %s, more than %s before the previous event was created at %s",
+			showEventID(ev.ID), formatTime(*attested), o.slack, formatTime(prev.CreatedAt))
+	}
+
+	return nil
+}
+
+func (o *AttestationOrder) violation(ev *nostr.Event, format string, args ...interface{}) error {
+	err := &AttestationOrderError{EventID: ev.ID, msg: fmt.Sprintf(format, args...)}
+	o.violations = append(o.violations, err)
+	return err
+}
+
+// Checks every attested event of the chain in order and continues the order after it.
+// Returns the first break of the order, the rest are in violations.
+func (o *AttestationOrder) follow(chain []nostr.Event, ots Timestamper) error {
+	var first error
+	for i := range chain {
+		var attested *time.Time
+		if ots.IsUpgraded(&chain[i]) {
+			_, attested, _ = ots.Verify(&chain[i])
+		}
+		if err := o.Check(&chain[i], attested); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Continues the order after a chain whose events were checked as they got attested. Attested
+// times don't go back along such a chain, so only its latest attested event is verified.
+func (o *AttestationOrder) resume(chain []nostr.Event, ots Timestamper) {
+	if len(chain) == 0 {
+		return
+	}
+	o.prev = &chain[len(chain)-1]
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !ots.IsUpgraded(&chain[i]) {
+			continue
+		}
+		if _, attested, _ := ots.Verify(&chain[i]); attested != nil {
+			o.last, o.last_id = *attested, chain[i].ID
+			return
+		}
+	}
+}
+
+// Checks the order again along the chain of an event whose attestation just completed. Append
+// let it in while it was pending, so every attested event before and after it is checked
+// again. Callers only warn about a violation and keep the event, later events may build on it
+// already. The events that break the order are kept in OutOfOrder, so verifying the stream
+// reports them from then on.
+func (es *EventStream) recheckAttestationOrder(ev *nostr.Event, ots Timestamper) error {
+	chain, err := es.chainTo(ev.ID)
+	if err != nil {
+		return err
+	}
+	// Events after it on the main chain, side branches end where they fork
+	for i := range es.Log {
+		if es.Log[i].ID == ev.ID {
+			chain = append(chain, es.Log[i+1:]...)
+			break
+		}
+	}
+	order := newAttestationOrder(ots.AttestationSlack())
+	err = order.follow(chain, ots)
+	for _, v := range order.violations {
+		if es.OutOfOrder == nil {
+			es.OutOfOrder = map[string]string{}
+		}
+		es.OutOfOrder[v.EventID] = v.Error()
+	}
+
+	return err
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
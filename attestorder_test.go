@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/phyro/go-opentimestamps/opentimestamps"
+)
+
+// Attests events at fixed times, events without a time are pending
+type fixedTimestamper struct {
+	attested map[string]time.Time
+}
+
+func (f *fixedTimestamper) Stamp(*nostr.Event) (string, error) {
+	return "", errors.New("not stamping")
+}
+
+func (f *fixedTimestamper) StampBatch([]*nostr.Event) ([]string, error) {
+	return nil, errors.New("not stamping")
+}
+
+func (f *fixedTimestamper) IsUpgraded(ev *nostr.Event) bool {
+	_, ok := f.attested[ev.ID]
+	return ok
+}
+
+func (f *fixedTimestamper) Upgrade(*nostr.Event) (*opentimestamps.Timestamp, error) {
+	return nil, ErrOTSPending
+}
+
+func (f *fixedTimestamper) Verify(ev *nostr.Event) (bool, *time.Time, error) {
+	if at, ok := f.attested[ev.ID]; ok {
+		return true, &at, nil
+	}
+	return true, nil, ErrOTSPending
+}
+
+func (f *fixedTimestamper) VerifyEvent(ev *nostr.Event) *OTSResult {
+	return &OTSResult{EventID: ev.ID, Status: OTS_STATUS_PENDING}
+}
+
+func (f *fixedTimestamper) HasTrustedHeaders() bool {
+	return true
+}
+
+func (f *fixedTimestamper) AttestationSlack() time.Duration {
+	return DEFAULT_ATTESTATION_SLACK
+}
+
+var orderBase = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func at(hours float64) *time.Time {
+	t := orderBase.Add(time.Duration(hours * float64(time.Hour)))
+	return &t
+}
+
+func TestAttestationOrderCheck(t *testing.T) {
+	// Every step is an event created at the hour and attested at the other one, nil is pending
+	type step struct {
+		created  float64
+		attested *time.Time
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// The step that breaks the order, -1 if none does
+		fails int
+	}{
+		{"in order", []step{{0, at(1)}, {2, at(3)}, {4, at(5)}}, -1},
+		{"same block", []step{{0, at(1)}, {0.5, at(1)}}, -1},
+		{"attested before the previous one", []step{{0, at(5)}, {1, at(3)}}, 1},
+		{"created within the slack after the block", []step{{0, at(1)}, {2.5, at(1)}}, -1},
+		{"created past the slack after the block", []step{{0, at(1)}, {3.5, at(1)}}, 1},
+		{"attested past the slack before the previous one was created", []step{{0, nil}, {5, nil}, {5.5, at(2)}}, 2},
+		{"pending events pass", []step{{0, at(5)}, {1, nil}, {6, at(6)}}, -1},
+		{"pending events don't reset the order", []step{{0, at(5)}, {1, nil}, {1.5, at(3)}}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := newAttestationOrder(DEFAULT_ATTESTATION_SLACK)
+			for i, s := range tt.steps {
+				ev := &nostr.Event{ID: string(rune('a' + i)), CreatedAt: *at(s.created)}
+				err := order.Check(ev, s.attested)
+				if i == tt.fails {
+					if !errors.Is(err, ErrAttestationOrder) {
+						t.Fatalf("step %d passed, want %v", i, ErrAttestationOrder)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRecheckAttestationOrder(t *testing.T) {
+	newStream := func() *EventStream {
+		log := []nostr.Event{}
+		prev := GENESIS
+		for i := 0; i < 4; i++ {
+			ev := nostr.Event{
+				ID:        string(rune('a' + i)),
+				CreatedAt: *at(float64(i)),
+				Tags:      nostr.Tags{nostr.Tag{"prev", prev}},
+			}
+			log = append(log, ev)
+			prev = ev.ID
+		}
+		return &EventStream{Log: log}
+	}
+
+	tests := []struct {
+		name     string
+		attested map[string]time.Time
+		// The events found out of order
+		out_of_order []string
+	}{
+		{"between its neighbours", map[string]time.Time{"a": *at(0.5), "b": *at(1.5), "c": *at(2.5)}, nil},
+		{"before the previous event", map[string]time.Time{"a": *at(1.5), "b": *at(1.2), "c": *at(2.5)}, []string{"b"}},
+		{"after the next event", map[string]time.Time{"a": *at(0.5), "b": *at(3), "c": *at(2.5)}, []string{"c"}},
+		{"neighbours pending", map[string]time.Time{"b": *at(1.5)}, nil},
+		{"earlier in the chain", map[string]time.Time{"a": *at(5), "b": *at(1.5), "c": *at(6)}, []string{"b"}},
+		{"several", map[string]time.Time{"a": *at(5), "b": *at(1.5), "c": *at(6), "d": *at(5.5)}, []string{"b", "d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es := newStream()
+			err := es.recheckAttestationOrder(&es.Log[1], &fixedTimestamper{attested: tt.attested})
+			if len(tt.out_of_order) == 0 {
+				if err != nil || len(es.OutOfOrder) != 0 {
+					t.Fatalf("got %v, out of order %v", err, es.OutOfOrder)
+				}
+				return
+			}
+			var order_err *AttestationOrderError
+			if !errors.Is(err, ErrAttestationOrder) || !errors.As(err, &order_err) || order_err.EventID != tt.out_of_order[0] {
+				t.Fatalf("got %v, want %v at %s", err, ErrAttestationOrder, tt.out_of_order[0])
+			}
+			if len(es.OutOfOrder) != len(tt.out_of_order) {
+				t.Fatalf("out of order %v, want %v", es.OutOfOrder, tt.out_of_order)
+			}
+			for _, id := range tt.out_of_order {
+				if _, ok := es.OutOfOrder[id]; !ok {
+					t.Fatalf("%s isn't out of order: %v", id, es.OutOfOrder)
+				}
+			}
+		})
+	}
+}
+
+// What an upgrade found out of order stays an error of the stream, also without verifying the
+// attestations again
+func TestAuditReportsOutOfOrder(t *testing.T) {
+	ots := &fixedTimestamper{attested: map[string]time.Time{}}
+	es := &EventStream{Name: "test", Log: []nostr.Event{}}
+	priv_key := nostr.GeneratePrivateKey()
+	prev := GENESIS
+	for i := 0; i < 3; i++ {
+		ev := nostr.Event{
+			PubKey:    getPubKey(priv_key),
+			CreatedAt: *at(float64(i)),
+			Kind:      nostr.KindTextNote,
+			Tags:      nostr.Tags{nostr.Tag{"prev", prev}},
+			Content:   "hello",
+		}
+		if err := ev.Sign(priv_key); err != nil {
+			t.Fatal(err)
+		}
+		es.Log = append(es.Log, ev)
+		prev = ev.ID
+	}
+	es.PubKey = getPubKey(priv_key)
+	ots.attested[es.Log[0].ID] = *at(5)
+	ots.attested[es.Log[1].ID] = *at(1.5)
+	if err := es.recheckAttestationOrder(&es.Log[1], ots); !errors.Is(err, ErrAttestationOrder) {
+		t.Fatalf("got %v, want %v", err, ErrAttestationOrder)
+	}
+
+	for _, check_ots := range []bool{true, false} {
+		found := 0
+		for _, f := range es.Audit(ots, check_ots).Findings {
+			if f.Check == "attestation" {
+				if f.EventID != es.Log[1].ID || f.Severity != SEVERITY_ERROR {
+					t.Fatalf("finding %+v", f)
+				}
+				found++
+			}
+		}
+		if found != 1 {
+			t.Fatalf("%d attestation order findings checking ots %v", found, check_ots)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+)
+
+// Something wrong with an event of a stream found while replaying it
+type Finding struct {
+	EventID string `json:"event_id,omitempty"`
+	// Position of the event in the main chain, -1 for side events and the stream as a whole
+	Index    int    `json:"index"`
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// The outcome of replaying a stream from the genesis. The stream is OK when no error was found,
+// warnings (pending attestations, forks) don't fail it.
+type VerifyReport struct {
+	Name     string    `json:"name"`
+	PubKey   string    `json:"pubkey"`
+	Events   int       `json:"events"`
+	Side     int       `json:"side_events"`
+	Root     string    `json:"mmr_root"`
+	Findings []Finding `json:"findings"`
+	OK       bool      `json:"ok"`
+}
+
+func (r *VerifyReport) add(ev *nostr.Event, index int, check string, severity string, format string, a ...interface{}) {
+	f := Finding{Index: index, Check: check, Severity: severity, Message: fmt.Sprintf(format, a...)}
+	if ev != nil {
+		f.EventID = ev.ID
+	}
+	r.Findings = append(r.Findings, f)
+	if severity == SEVERITY_ERROR {
+		r.OK = false
+	}
+}
+
+func (r *VerifyReport) count(severity string) int {
+	num := 0
+	for _, f := range r.Findings {
+		if f.Severity == severity {
+			num++
+		}
+	}
+	return num
+}
+
+// Replays the whole stream from the genesis and checks every event the way Append would, without
+// trusting anything we stored. Without check_ots the attestations are only checked to commit
+// to their event, the calendar and the blocks aren't asked.
+func (es *EventStream) Audit(ots Timestamper, check_ots bool) *VerifyReport {
+	report := &VerifyReport{
+		Name:     es.Name,
+		PubKey:   es.PubKey,
+		Events:   len(es.Log),
+		Side:     len(es.Side),
+		Root:     buildMMR(es.Log).Root(),
+		Findings: []Finding{},
+		OK:       true,
+	}
+
+	seen := map[string]bool{}
+	used_prevs := map[string]string{}
+	prev := GENESIS
+	order := newAttestationOrder(ots.AttestationSlack())
+	for i := range es.Log {
+		ev := es.Log[i]
+		checkEvent(report, &ev, i)
+		if seen[ev.ID] {
+			report.add(&ev, i, "duplicate", SEVERITY_ERROR, "the event is on the chain more than once")
+		}
+		seen[ev.ID] = true
+		if get_prev(ev) != prev {
+			report.add(&ev, i, "prev", SEVERITY_ERROR, "expected prev %s, got %s", prev, get_prev(ev))
+		}
+		if other, ok := used_prevs[get_prev(ev)]; ok {
+			report.add(&ev, i, "duplicate-prev", SEVERITY_ERROR, "builds on the same event as %s", other)
+		}
+		used_prevs[get_prev(ev)] = ev.ID
+		prev = ev.ID
+		if err := es.checkKeyRules(es.Log[:i], ev); err != nil {
+			report.add(&ev, i, "key", SEVERITY_ERROR, err.Error())
+		}
+
+		// Attestation
+		if !checkAttestation(report, &ev, i) || !check_ots {
+			// Still the event the next one builds on
+			order.Check(&es.Log[i], nil)
+			continue
+		}
+		is_good, attested_time, err := ots.Verify(&ev)
+		if !is_good {
+			msg := "invalid attestation"
+			if err != nil {
+				msg = err.Error()
+			}
+			report.add(&ev, i, "ots", SEVERITY_ERROR, msg)
+			attested_time = nil
+		} else if err != nil {
+			report.add(&ev, i, "ots", SEVERITY_WARNING, "attestation is %s", err.Error())
+		}
+		if err := order.Check(&es.Log[i], attested_time); err != nil {
+			report.add(&ev, i, "attestation", SEVERITY_ERROR, err.Error())
+		}
+	}
+	// Breaks of the order found when attestations got upgraded, also without checking them now
+	reported := map[string]bool{}
+	for _, v := range order.violations {
+		reported[v.EventID] = true
+	}
+	for i := range es.Log {
+		if msg, ok := es.OutOfOrder[es.Log[i].ID]; ok && !reported[es.Log[i].ID] {
+			report.add(&es.Log[i], i, "attestation", SEVERITY_ERROR, msg)
+		}
+	}
+	for i := range es.Side {
+		if msg, ok := es.OutOfOrder[es.Side[i].ID]; ok {
+			report.add(&es.Side[i], -1, "attestation", SEVERITY_ERROR, msg)
+		}
+	}
+
+	// The stored MMR must commit to the chain we replayed
+	if es.MMR != nil {
+		if es.MMR.Size != len(es.Log) {
+			report.add(nil, -1, "mmr", SEVERITY_WARNING, "the stored MMR covers %d events, the chain has %d", es.MMR.Size, len(es.Log))
+		} else if es.MMR.Root() != report.Root {
+			report.add(nil, -1, "mmr", SEVERITY_ERROR, "the stored MMR root %s doesn't match the chain root %s", es.MMR.Root(), report.Root)
+		}
+	}
+
+	// Side events must be valid events that link into the stream
+	for i := range es.Side {
+		ev := es.Side[i]
+		checkEvent(report, &ev, -1)
+		if seen[ev.ID] {
+			report.add(&ev, -1, "duplicate", SEVERITY_ERROR, "the side event is on the main chain too")
+		}
+		seen[ev.ID] = true
+		chain, err := es.chainTo(get_prev(ev))
+		if err != nil {
+			report.add(&ev, -1, "prev", SEVERITY_ERROR, err.Error())
+			continue
+		}
+		if err := es.checkKeyRules(chain, ev); err != nil {
+			report.add(&ev, -1, "key", SEVERITY_ERROR, err.Error())
+		}
+		checkAttestation(report, &ev, -1)
+	}
+	for _, proof := range es.Forks {
+		if err := proof.Verify(); err != nil {
+			report.add(nil, -1, "fork", SEVERITY_ERROR, "invalid fork proof at %s: %s", proof.Ancestor, err.Error())
+			continue
+		}
+		report.add(nil, -1, "fork", SEVERITY_WARNING, "the author signed both %s and %s on top of %s",
+			proof.A.ID, proof.B.ID, proof.Ancestor)
+	}
+
+	return report
+}
+
+// Checks the event id and signature
+func checkEvent(report *VerifyReport, ev *nostr.Event, index int) {
+	if ev.GetID() != ev.ID {
+		report.add(ev, index, "id", SEVERITY_ERROR, "the id doesn't match the event, expected %s", ev.GetID())
+	}
+	if ok, _ := ev.CheckSignature(); !ok {
+		report.add(ev, index, "signature", SEVERITY_ERROR, "invalid signature")
+	}
+}
+
+// Checks the event has an attestation and that it commits to the event
+func checkAttestation(report *VerifyReport, ev *nostr.Event, index int) bool {
+	if ev.GetExtraString("ots") == "" {
+		report.add(ev, index, "ots", SEVERITY_ERROR, "the event is missing the \"ots\" field")
+		return false
+	}
+	f, err := parseOTS(ev)
+	if err == nil {
+		err = checkOTSDigest(ev, f)
+	}
+	if err != nil {
+		report.add(ev, index, "ots", SEVERITY_ERROR, err.Error())
+		return false
+	}
+	return true
+}
+
+func (r *VerifyReport) Print() {
+	fmt.Printf("Verifying %s (%s)\n", r.Name, showPubKey(r.PubKey))
+	fmt.Printf("Events: %d, side events: %d\n", r.Events, r.Side)
+	fmt.Printf("MMR root: %s\n", r.Root)
+	for _, f := range r.Findings {
+		at := "stream"
+		if f.EventID != "" && f.Index >= 0 {
+			at = fmt.Sprintf("#%d %s", f.Index+1, shortenShown(showEventID(f.EventID)))
+		} else if f.EventID != "" {
+			at = fmt.Sprintf("side %s", shortenShown(showEventID(f.EventID)))
+		}
+		fmt.Printf("[%s] %s: %s: %s\n", f.Severity, at, f.Check, f.Message)
+	}
+	status := "OK"
+	if !r.OK {
+		status = "FAILED"
+	}
+	fmt.Printf("%s: %d errors, %d warnings\n", status, r.count(SEVERITY_ERROR), r.count(SEVERITY_WARNING))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// A bundle is a gzipped tar archive that holds everything needed to verify a stream without
+// any relay:
+//
+//	manifest.json     name, pubkey, head and relays of the stream
+//	events.jsonl      the signed events of the main chain, one per line, in order
+//	ots/<id>.ots      the attestation of every event as a standard .ots file
+const BUNDLE_VERSION = 1
+
+const (
+	BUNDLE_MANIFEST = "manifest.json"
+	BUNDLE_EVENTS   = "events.jsonl"
+	BUNDLE_OTS_DIR  = "ots"
+)
+
+type BundleManifest struct {
+	Version int      `json:"version"`
+	Name    string   `json:"name"`
+	PubKey  string   `json:"pubkey"`
+	Head    string   `json:"head"`
+	Size    int      `json:"size"`
+	MMRRoot string   `json:"mmr_root"`
+	Relays  []string `json:"relays"`
+}
+
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+// Writes the main chain of the stream to a bundle at the path
+func (es *EventStream) Export(out string) error {
+	manifest := BundleManifest{
+		Version: BUNDLE_VERSION,
+		Name:    es.Name,
+		PubKey:  es.PubKey,
+		Head:    es.GetHead(),
+		Size:    es.Size(),
+		MMRRoot: es.MMRRoot(),
+		Relays:  es.ListRelays(),
+	}
+	manifest_json, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	events := new(bytes.Buffer)
+	for _, ev := range es.Log {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		events.Write(append(line, '\n'))
+	}
+
+	files := []bundleFile{
+		{BUNDLE_MANIFEST, manifest_json},
+		{BUNDLE_EVENTS, events.Bytes()},
+	}
+	for _, ev := range es.Log {
+		ots, err := b64.StdEncoding.DecodeString(ev.GetExtraString("ots"))
+		if err != nil {
+			return fmt.Errorf("can't decode the attestation of %s: %v", ev.ID, err)
+		}
+		files = append(files, bundleFile{path.Join(BUNDLE_OTS_DIR, ev.ID+".ots"), ots})
+	}
+
+	// A failed export leaves no truncated bundle behind
+	return writeFileAtomic(out, 0644, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		for _, file := range files {
+			hdr := &tar.Header{
+				Name:    file.name,
+				Mode:    0644,
+				Size:    int64(len(file.data)),
+				ModTime: time.Now(),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(file.data); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+}
+
+// Reads the manifest and the events of a bundle. The attestation of every event is taken
+// from its .ots file, which may be more recent than the one in the event.
+func readBundle(in string) (*BundleManifest, []nostr.Event, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s is not a stream bundle: %v", in, err)
+	}
+	tr := tar.NewReader(gz)
+
+	var manifest *BundleManifest
+	events := []nostr.Event{}
+	ots_files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case hdr.Name == BUNDLE_MANIFEST:
+			manifest = &BundleManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, nil, fmt.Errorf("can't parse the bundle manifest: %v", err)
+			}
+		case hdr.Name == BUNDLE_EVENTS:
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			for scanner.Scan() {
+				var ev nostr.Event
+				if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+					return nil, nil, fmt.Errorf("can't parse event %d of the bundle: %v", len(events)+1, err)
+				}
+				events = append(events, ev)
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, nil, err
+			}
+		case path.Dir(hdr.Name) == BUNDLE_OTS_DIR && strings.HasSuffix(hdr.Name, ".ots"):
+			ots_files[strings.TrimSuffix(path.Base(hdr.Name), ".ots")] = data
+		}
+	}
+	if manifest == nil {
+		return nil, nil, errors.New("the bundle has no manifest")
+	}
+	if manifest.Version != BUNDLE_VERSION {
+		return nil, nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+	for i := range events {
+		ots, ok := ots_files[events[i].ID]
+		if !ok {
+			return nil, nil, fmt.Errorf("the bundle has no attestation for event %s", events[i].ID)
+		}
+		events[i].SetExtra("ots", b64.StdEncoding.EncodeToString(ots))
+	}
+
+	return manifest, events, nil
+}
+
+// Rebuilds a stream from a bundle. Every event goes through Append, so the bundle is held
+// to the same rules as events we get from relays. Nothing is saved unless all of it is valid.
+func importBundle(store StreamStore, ots Timestamper, in string, name string) (*EventStream, error) {
+	manifest, events, err := readBundle(in)
+	if err != nil {
+		return nil, err
+	}
+	if !isHexKey(manifest.PubKey) {
+		return nil, fmt.Errorf("invalid pubkey %s in the bundle manifest", manifest.PubKey)
+	}
+	if existing, err := store.GetEventStream(manifest.PubKey); err == nil {
+		return nil, fmt.Errorf("stream %s (%s) already exists", existing.Name, manifest.PubKey)
+	}
+	if name == "" {
+		name = manifest.Name
+	}
+	if name == "" {
+		return nil, errors.New("name can't be empty")
+	}
+
+	es := &EventStream{
+		Name:    name,
+		PrivKey: "", // the bundle never holds the private key
+		PubKey:  manifest.PubKey,
+		Log:     []nostr.Event{},
+	}
+	for _, url := range manifest.Relays {
+		es.AddRelay(url)
+	}
+	for _, ev := range events {
+		if get_prev(ev) != es.GetHead() {
+			return nil, fmt.Errorf("event %s of the bundle doesn't build on %s", ev.ID, es.GetHead())
+		}
+		if err := es.Append(ev, ots); err != nil {
+			return nil, fmt.Errorf("invalid event %s in the bundle: %v", ev.ID, err)
+		}
+	}
+	if es.GetHead() != manifest.Head || es.Size() != manifest.Size {
+		return nil, fmt.Errorf("the bundle events end at %s after %d events, the manifest says %s after %d",
+			es.GetHead(), es.Size(), manifest.Head, manifest.Size)
+	}
+	if manifest.MMRRoot != "" && es.MMRRoot() != manifest.MMRRoot {
+		return nil, fmt.Errorf("the MMR root of the bundle events %s doesn't match the manifest root %s", es.MMRRoot(), manifest.MMRRoot)
+	}
+	if err := store.SaveEventStream(es); err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
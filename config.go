@@ -2,20 +2,74 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
+	"golang.org/x/exp/slices"
 )
 
 const CONFIG_BASE_DIR = "~/.config/nostr"
 const CONFIG_FILE = "config.json"
 
-type Config struct {
-	DataDir string        `json:"-"`
+// Storage backends for event streams
+const (
+	BACKEND_JSON   = "json"
+	BACKEND_SQLITE = "sqlite"
+)
+
+const SQLITE_FILE = "es.db"
+
+// How a stream picks its main chain when it forks
+const (
+	FORK_FIRST_SEEN   = "first-seen"
+	FORK_EARLIEST_OTS = "earliest-ots"
+	FORK_FREEZE       = "freeze"
+)
+
+// Calendars events get stamped with unless configured otherwise
+var DEFAULT_CALENDARS = []string{
+	"https://alice.btc.calendar.opentimestamps.org",
+	"https://bob.btc.calendar.opentimestamps.org",
+	"https://finney.calendar.eternitywall.com",
+	"https://btc.calendar.catallaxy.com",
+}
+
+const DEFAULT_CALENDAR_QUORUM = 2
+
+const DEFAULT_PROFILE = "default"
+
+// Settings that belong to a bitcoin network. The settings of the active profile are at the top
+// of the config, the other profiles wait in Profiles.
+type Profile struct {
+	Network string        `json:"network"`
 	BTCRPC  *BTCRPCClient `json:"btcrpc"`
+	// OpenTimestamps calendars and how many of them have to stamp an event
+	Calendars      []string `json:"calendars"`
+	CalendarQuorum int      `json:"calendar_quorum"`
+	// Where block headers for verifying attestations come from and an optional second
+	// source that has to agree with it
+	Headers    *HeaderSourceConfig `json:"headers"`
+	CrossCheck *HeaderSourceConfig `json:"headers_cross_check"`
+}
+
+type Config struct {
+	DataDir string `json:"-"`
+	Profile
+	ActiveProfile string              `json:"profile"`
+	Profiles      map[string]*Profile `json:"profiles,omitempty"`
+	Backend       string              `json:"backend"`
+	// How keys and event ids are printed, hex or bech32
+	Display string `json:"display"`
+	// One of the FORK_* policies
+	ForkPolicy string `json:"fork_policy"`
+	// How long after its attestation an event may claim to be created, e.g. "2h"
+	AttestationSlack string `json:"attestation_slack,omitempty"`
 }
 
 func (c *Config) Init() {
@@ -23,6 +77,114 @@ func (c *Config) Init() {
 		base_dir_exp, _ := homedir.Expand(CONFIG_BASE_DIR)
 		c.DataDir = base_dir_exp
 	}
+	if c.Backend == "" {
+		c.Backend = BACKEND_JSON
+	}
+	if c.Display == "" {
+		c.Display = DISPLAY_HEX
+	}
+	if c.ForkPolicy == "" {
+		c.ForkPolicy = FORK_FIRST_SEEN
+	}
+	if c.ActiveProfile == "" {
+		c.ActiveProfile = DEFAULT_PROFILE
+	}
+	if c.Network == "" {
+		c.Network = NETWORK_MAINNET
+	}
+	network, err := getNetwork(c.Network)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if c.Calendars == nil {
+		c.Calendars = append([]string{}, network.calendars...)
+	}
+	if c.CalendarQuorum == 0 {
+		c.CalendarQuorum = DEFAULT_CALENDAR_QUORUM
+		if len(c.Calendars) < DEFAULT_CALENDAR_QUORUM {
+			c.CalendarQuorum = 1
+		}
+	}
+	if err = c.Profile.check(c.ActiveProfile); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// Catches calendar settings every stamp would fail with. Profiles on networks without public
+// calendars start with none until one is added, an empty list elsewhere was set by hand.
+func (p *Profile) check(name string) error {
+	network, err := getNetwork(p.Network)
+	if err != nil {
+		return fmt.Errorf("profile %s: %v", name, err)
+	}
+	if p.Calendars != nil && len(p.Calendars) == 0 && len(network.calendars) > 0 {
+		return fmt.Errorf("profile %s has no calendars, remove \"calendars\" from the config to use the defaults", name)
+	}
+	if len(p.Calendars) > 0 && (p.CalendarQuorum < 0 || p.CalendarQuorum > len(p.Calendars)) {
+		return fmt.Errorf("profile %s needs %d of its %d calendars, the quorum must be between 1 and %d", name, p.CalendarQuorum, len(p.Calendars), len(p.Calendars))
+	}
+	return nil
+}
+
+func (c *Config) GetNetwork() *BitcoinNetwork {
+	network, err := getNetwork(c.Network)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return network
+}
+
+// Creates a profile on the network with its default settings and makes it active
+func (c *Config) AddProfile(name string, network string) error {
+	if _, ok := c.Profiles[name]; ok || name == c.ActiveProfile {
+		return fmt.Errorf("profile %s already exists", name)
+	}
+	if _, err := getNetwork(network); err != nil {
+		return err
+	}
+	c.activate(name, &Profile{Network: network})
+
+	return nil
+}
+
+func (c *Config) SwitchProfile(name string) error {
+	if name == c.ActiveProfile {
+		return nil
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return fmt.Errorf("profile %s doesn't exist, add it with es profile add %s", name, name)
+	}
+	c.activate(name, profile)
+
+	return nil
+}
+
+// Puts the active profile away and moves the settings of the profile to the top of the config
+func (c *Config) activate(name string, profile *Profile) {
+	if c.Profiles == nil {
+		c.Profiles = map[string]*Profile{}
+	}
+	active := c.Profile
+	c.Profiles[c.ActiveProfile] = &active
+	delete(c.Profiles, name)
+	c.Profile = *profile
+	c.ActiveProfile = name
+	c.Init()
+	c.Save()
+}
+
+func (c *Config) RemoveProfile(name string) error {
+	if name == c.ActiveProfile {
+		return errors.New("can't remove the active profile, switch to another one first")
+	}
+	if _, ok := c.Profiles[name]; !ok {
+		return fmt.Errorf("profile %s doesn't exist", name)
+	}
+	delete(c.Profiles, name)
+	c.Save()
+
+	return nil
 }
 
 func (c *Config) Load() {
@@ -33,7 +195,8 @@ func (c *Config) Load() {
 	_, err := os.Open(path)
 	if err != nil {
 		// File doesn't exist, create it
-		c = &Config{DataDir: base_dir_exp}
+		c.DataDir = base_dir_exp
+		c.Init()
 		c.Save()
 		_, _ = os.Open(path)
 	}
@@ -42,20 +205,24 @@ func (c *Config) Load() {
 	if err != nil {
 		log.Fatal("can't parse config file " + path + ": " + err.Error())
 	}
+	for name, profile := range c.Profiles {
+		if profile.Network == "" {
+			profile.Network = NETWORK_MAINNET
+		}
+		if err = profile.check(name); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
 	c.Init()
 }
 
 func (c *Config) Save() {
 	path := filepath.Join(c.DataDir, CONFIG_FILE)
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	// The config holds the bitcoin rpc credentials
+	err := writeJSONAtomic(path, 0600, *c)
 	if err != nil {
-		log.Fatal("can't open config file " + path + ": " + err.Error())
-		return
+		log.Fatal("can't write config file " + path + ": " + err.Error())
 	}
-
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	enc.Encode(*c)
 }
 
 // Implement BitcoinRPCManager interface
@@ -77,6 +244,13 @@ func (c *Config) ConfigureBitcoinRPC(host string, user string, password string)
 	if err != nil {
 		return err
 	}
+	info, err := client.GetBlockChainInfo()
+	if err != nil {
+		return err
+	}
+	if network := c.GetNetwork(); info.Chain != network.chain {
+		return fmt.Errorf("the node is on %s, profile %s is on %s", info.Chain, c.ActiveProfile, network.Name)
+	}
 	fmt.Printf("Bitcoin node version: %d\n", ver)
 	c.Save()
 
@@ -85,5 +259,151 @@ func (c *Config) ConfigureBitcoinRPC(host string, user string, password string)
 
 func (c *Config) UnsetBitcoinRPC() {
 	c.BTCRPC = nil
+	// Sources that used the node fall back to the defaults
+	if c.Headers != nil && c.Headers.Kind == HEADERS_RPC {
+		c.Headers = nil
+	}
+	if c.CrossCheck != nil && c.CrossCheck.Kind == HEADERS_RPC {
+		c.CrossCheck = nil
+	}
+	c.Save()
+}
+
+func (c *Config) GetAttestationSlack() time.Duration {
+	if c.AttestationSlack == "" {
+		return DEFAULT_ATTESTATION_SLACK
+	}
+	slack, err := time.ParseDuration(c.AttestationSlack)
+	if err != nil || slack < 0 {
+		log.Printf("invalid attestation slack %s, using %s", c.AttestationSlack, DEFAULT_ATTESTATION_SLACK)
+		return DEFAULT_ATTESTATION_SLACK
+	}
+	return slack
+}
+
+func (c *Config) SetAttestationSlack(slack time.Duration) error {
+	if slack < 0 {
+		return errors.New("the attestation slack can't be negative")
+	}
+	c.AttestationSlack = slack.String()
+	c.Save()
+
+	return nil
+}
+
+// The block header source. Without one configured it's our node if we have one, otherwise
+// blockchain.info on mainnet and the esplora api of the other networks.
+func (c *Config) GetHeaderSource() *HeaderSourceConfig {
+	if c.Headers != nil {
+		return c.Headers
+	}
+	if c.BTCRPC != nil {
+		return &HeaderSourceConfig{Kind: HEADERS_RPC}
+	}
+	switch network := c.GetNetwork(); {
+	case network.Name == NETWORK_MAINNET:
+		return &HeaderSourceConfig{Kind: HEADERS_BLOCKCHAIN_INFO}
+	case network.esplora != "":
+		return &HeaderSourceConfig{Kind: HEADERS_ESPLORA}
+	}
+	return &HeaderSourceConfig{Kind: HEADERS_RPC}
+}
+
+// Sets the block header source, or the cross-check source with cross_check. The cross-check
+// source is turned off with the "off" kind.
+func (c *Config) SetHeaderSource(kind string, location string, cross_check bool) error {
+	if cross_check && kind == "off" {
+		c.CrossCheck = nil
+		c.Save()
+		return nil
+	}
+	sc := &HeaderSourceConfig{Kind: kind, Location: location}
+	if _, err := newHeaderSource(c, sc); err != nil {
+		return err
+	}
+	if kind == HEADERS_FILE {
+		if _, err := os.Stat(location); err != nil {
+			return err
+		}
+	}
+	if cross_check {
+		if *sc == *c.GetHeaderSource() {
+			return errors.New("the cross-check source must differ from the block header source")
+		}
+		c.CrossCheck = sc
+	} else {
+		c.Headers = sc
+	}
+	c.Save()
+
+	return nil
+}
+
+func (c *Config) SetBackend(backend string) error {
+	if backend != BACKEND_JSON && backend != BACKEND_SQLITE {
+		return fmt.Errorf("unknown backend: %s", backend)
+	}
+	c.Backend = backend
+	c.Save()
+
+	return nil
+}
+
+func (c *Config) SetDisplay(format string) error {
+	if format != DISPLAY_HEX && format != DISPLAY_BECH32 {
+		return fmt.Errorf("unknown display format: %s", format)
+	}
+	c.Display = format
 	c.Save()
+
+	return nil
+}
+
+func (c *Config) SetForkPolicy(policy string) error {
+	if policy != FORK_FIRST_SEEN && policy != FORK_EARLIEST_OTS && policy != FORK_FREEZE {
+		return fmt.Errorf("unknown fork policy: %s", policy)
+	}
+	c.ForkPolicy = policy
+	c.Save()
+
+	return nil
+}
+
+func (c *Config) AddCalendar(url string) error {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return fmt.Errorf("calendar url must start with https:// or http://: %s", url)
+	}
+	url = strings.TrimSuffix(url, "/")
+	if slices.Contains(c.Calendars, url) {
+		return errors.New("calendar was already added")
+	}
+	c.Calendars = append(c.Calendars, url)
+	c.Save()
+
+	return nil
+}
+
+func (c *Config) RemoveCalendar(url string) error {
+	url = strings.TrimSuffix(url, "/")
+	idx := slices.Index(c.Calendars, url)
+	if idx == -1 {
+		return errors.New("calendar url was not on the list")
+	}
+	if len(c.Calendars)-1 < c.CalendarQuorum {
+		return fmt.Errorf("the quorum needs %d calendars, lower it first", c.CalendarQuorum)
+	}
+	c.Calendars = slices.Delete(c.Calendars, idx, idx+1)
+	c.Save()
+
+	return nil
+}
+
+func (c *Config) SetCalendarQuorum(quorum int) error {
+	if quorum < 1 || quorum > len(c.Calendars) {
+		return fmt.Errorf("the quorum must be between 1 and the %d calendars", len(c.Calendars))
+	}
+	c.CalendarQuorum = quorum
+	c.Save()
+
+	return nil
 }
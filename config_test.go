@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfileCheck(t *testing.T) {
+	two := []string{"https://a.example", "https://b.example"}
+
+	tests := []struct {
+		name    string
+		profile Profile
+		err     string
+	}{
+		{"defaults", Profile{Network: NETWORK_MAINNET}, ""},
+		{"quorum of all", Profile{Network: NETWORK_MAINNET, Calendars: two, CalendarQuorum: 2}, ""},
+		{"regtest without calendars", Profile{Network: NETWORK_REGTEST, Calendars: []string{}, CalendarQuorum: 1}, ""},
+		{"no calendars on mainnet", Profile{Network: NETWORK_MAINNET, Calendars: []string{}, CalendarQuorum: 1}, "profile test has no calendars"},
+		{"quorum above the calendars", Profile{Network: NETWORK_MAINNET, Calendars: two, CalendarQuorum: 3}, "profile test needs 3 of its 2 calendars"},
+		{"negative quorum", Profile{Network: NETWORK_REGTEST, Calendars: two, CalendarQuorum: -1}, "the quorum must be between 1 and 2"},
+		{"unknown network", Profile{Network: "moonnet"}, "profile test: unknown bitcoin network moonnet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.profile.check("test")
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
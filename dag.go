@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// A stream is a DAG of events keyed by their id. Normally it's a single chain, but an author
+// can sign two events on top of the same event. The branch the fork policy picks is the main
+// chain in Log, the events of the other branches are kept in Side.
+
+// Set from the config when the service loads
+var forkPolicy = FORK_FIRST_SEEN
+
+func (es *EventStream) HasEvent(id string) bool {
+	_, ok := es.getEvent(id)
+	return ok
+}
+
+func (es *EventStream) getEvent(id string) (*nostr.Event, bool) {
+	for _, evs := range [][]nostr.Event{es.Log, es.Side} {
+		for i := range evs {
+			if evs[i].ID == id {
+				return &evs[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Ids of all the events we know, including the genesis
+func (es *EventStream) eventIDs() map[string]bool {
+	ids := map[string]bool{GENESIS: true}
+	for _, ev := range es.Log {
+		ids[ev.ID] = true
+	}
+	for _, ev := range es.Side {
+		ids[ev.ID] = true
+	}
+	return ids
+}
+
+func sameIDs(a map[string]bool, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id := range a {
+		if !b[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the chain of events from the genesis up to and including the event with the id.
+// The chain may go through a side branch.
+func (es *EventStream) chainTo(id string) ([]nostr.Event, error) {
+	branch := []nostr.Event{}
+	for id != GENESIS {
+		for i, ev := range es.Log {
+			if ev.ID == id {
+				chain := append([]nostr.Event{}, es.Log[:i+1]...)
+				return append(chain, branch...), nil
+			}
+		}
+		ev, ok := es.getEvent(id)
+		// A side branch can't be longer than all the side events
+		if !ok || len(branch) > len(es.Side) {
+			return nil, fmt.Errorf("reference to unknown previous event %s", id)
+		}
+		branch = append([]nostr.Event{*ev}, branch...)
+		id = get_prev(*ev)
+	}
+
+	return branch, nil
+}
+
+// With the freeze policy a stream stops accepting events once it forks
+func (es *EventStream) IsFrozen() bool {
+	return forkPolicy == FORK_FREEZE && len(es.Forks) > 0
+}
+
+// Keeps an event that doesn't extend the main chain and resolves the fork it creates
+func (es *EventStream) addBranchEvent(ev nostr.Event, ots Timestamper) {
+	es.Side = append(es.Side, ev)
+	if sibling := es.findSibling(ev); sibling != nil {
+		es.AddForkProof(newForkProof(*sibling, ev))
+	}
+	if forkPolicy != FORK_EARLIEST_OTS {
+		return
+	}
+
+	// Only a new branch off the main chain can take over, events that extend a side branch
+	// don't change which side of the fork was attested first
+	prev := get_prev(ev)
+	fork_at := -1
+	if prev != GENESIS {
+		for i, known := range es.Log {
+			if known.ID == prev {
+				fork_at = i
+			}
+		}
+		if fork_at == -1 {
+			return
+		}
+	}
+	if fork_at+1 >= len(es.Log) {
+		return
+	}
+	main_time := attestedAt(ots, es.Log[fork_at+1])
+	branch_time := attestedAt(ots, ev)
+	if branch_time == nil || (main_time != nil && !branch_time.Before(*main_time)) {
+		return
+	}
+
+	// The branch was attested first, it becomes the main chain
+	orphaned := es.Log[fork_at+1:]
+	es.Log = append(append([]nostr.Event{}, es.Log[:fork_at+1]...), ev)
+	side := []nostr.Event{}
+	for _, known := range es.Side {
+		if known.ID != ev.ID {
+			side = append(side, known)
+		}
+	}
+	es.Side = append(side, orphaned...)
+	// The MMR only covers the main chain
+	es.MMR = buildMMR(es.Log)
+}
+
+// Time the event was attested at or nil if the attestation is still pending
+func attestedAt(ots Timestamper, ev nostr.Event) *time.Time {
+	ok, attested_time, _ := ots.Verify(&ev)
+	if !ok {
+		return nil
+	}
+	return attested_time
+}
+
+// Groups the side events into branches. Every branch starts with an event that builds on
+// another branch and lists its events parents first.
+func (es *EventStream) Branches() [][]nostr.Event {
+	in_side := map[string]bool{}
+	children := map[string][]nostr.Event{}
+	for _, ev := range es.Side {
+		in_side[ev.ID] = true
+		children[get_prev(ev)] = append(children[get_prev(ev)], ev)
+	}
+	branches := [][]nostr.Event{}
+	for _, root := range es.Side {
+		if in_side[get_prev(root)] {
+			continue
+		}
+		branch := []nostr.Event{}
+		queue := []nostr.Event{root}
+		for len(queue) > 0 {
+			ev := queue[0]
+			queue = queue[1:]
+			branch = append(branch, ev)
+			queue = append(queue, children[ev.ID]...)
+		}
+		branches = append(branches, branch)
+	}
+
+	return branches
+}
+
+// Orders sibling events by creation time and id so forks resolve the same way everywhere
+func sortEventsByTime(evs []nostr.Event) {
+	sort.SliceStable(evs, func(i, j int) bool {
+		if evs[i].CreatedAt.Equal(evs[j].CreatedAt) {
+			return evs[i].ID < evs[j].ID
+		}
+		return evs[i].CreatedAt.Before(evs[j].CreatedAt)
+	})
+}
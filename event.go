@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
 	"github.com/dustin/go-humanize"
@@ -17,6 +18,8 @@ var kindNames = map[int]string{
 	nostr.KindContactList:            "Contact List",
 	nostr.KindEncryptedDirectMessage: "Encrypted Message",
 	nostr.KindDeletion:               "Deletion Notice",
+	KindKeyRevocation:                "Key Revocation",
+	KindKeyLink:                      "Key Rotation",
 }
 
 func findEvent(n *Nostr, id string) (*nostr.Event, error) {
@@ -64,41 +67,54 @@ func findEvent(n *Nostr, id string) (*nostr.Event, error) {
 // 	return nil
 // }
 
-// Find the next events in the hashchain
-func findNextEvents(n *Nostr, pubkey string, prev string) ([]*nostr.Event, error) {
+// Find the events of the author that build on the events we know. Events are returned in
+// the order they can be appended, parents before their children. Conflicting events are
+// returned too, appending them records the fork.
+func findNextEvents(n *Nostr, pubkey string, known map[string]bool) ([]*nostr.Event, error) {
 	result := []*nostr.Event{}
-	// Mapping from prev value to event struct. Used to construct the sequence that we return
-	prev_to_event := map[string]nostr.Event{}
+	// Mapping from prev value to the events building on it
+	prev_to_events := map[string][]nostr.Event{}
 	evs, err := n.SingleQueryPool(nostr.Filter{Authors: []string{pubkey}})
 	if err != nil {
 		return nil, err
 	}
-	// TODO: make the evs slice unique
+	seen := map[string]bool{}
 	for _, ev := range evs {
-		for _, tag := range ev.Tags {
-			if tag.Key() != "prev" {
-				continue
-			}
-			entry, exists := prev_to_event[tag.Value()]
-			// if the entry exists, make sure the entry has the same id as event id
-			if exists && ev.ID != entry.ID {
-				fmt.Printf("\nConflict detected. Two events with the same prev. Ids: %s, %s", entry.ID, ev.ID)
-				return nil, errors.New("Conflict")
-			} else {
-				prev_to_event[tag.Value()] = ev
-			}
+		// Relays return the same event and could make up conflicts, only signed events count
+		if seen[ev.ID] || known[ev.ID] {
+			continue
+		}
+		if ok, _ := ev.CheckSignature(); !ok {
+			continue
 		}
+		seen[ev.ID] = true
+		prev := get_prev(ev)
+		prev_to_events[prev] = append(prev_to_events[prev], ev)
 	}
 
-	// Construct a chain of events
-	for {
-		ev, ok := prev_to_event[prev]
-		if !ok {
-			return result, nil
+	// Walk the events breadth first from the ones we know
+	queue := []nostr.Event{}
+	prevs := []string{}
+	for prev := range prev_to_events {
+		if known[prev] {
+			prevs = append(prevs, prev)
 		}
+	}
+	sort.Strings(prevs)
+	for _, prev := range prevs {
+		sortEventsByTime(prev_to_events[prev])
+		queue = append(queue, prev_to_events[prev]...)
+	}
+	for len(queue) > 0 {
+		ev := queue[0]
+		queue = queue[1:]
 		result = append(result, &ev)
-		prev = ev.ID
+		next := prev_to_events[ev.ID]
+		sortEventsByTime(next)
+		queue = append(queue, next...)
 	}
+
+	return result, nil
 }
 
 func printEvent(evt nostr.Event, name *string, verbose bool) {
@@ -107,20 +123,20 @@ func printEvent(evt nostr.Event, name *string, verbose bool) {
 		kind = "Unknown Kind"
 	}
 
-	var ID string = shorten(evt.ID)
-	var fromField string = shorten(evt.PubKey)
-	var prev string = get_prev(evt)
+	var ID string = shortenShown(showEventID(evt.ID))
+	var fromField string = shortenShown(showPubKey(evt.PubKey))
+	var prev string = showEventID(get_prev(evt))
 
 	if name != nil {
-		fromField = fmt.Sprintf("%s (%s)", *name, shorten(evt.PubKey))
+		fromField = fmt.Sprintf("%s (%s)", *name, shortenShown(showPubKey(evt.PubKey)))
 	}
 	if verbose {
-		ID = evt.ID
+		ID = showEventID(evt.ID)
 
 		if name == nil {
-			fromField = evt.PubKey
+			fromField = showPubKey(evt.PubKey)
 		} else {
-			fromField = fmt.Sprintf("%s (%s)", *name, evt.PubKey)
+			fromField = fmt.Sprintf("%s (%s)", *name, showPubKey(evt.PubKey))
 		}
 	}
 
@@ -135,6 +151,17 @@ func printEvent(evt nostr.Event, name *string, verbose bool) {
 	// TODO: Support other kinds
 	case nostr.KindTextNote:
 		fmt.Print("  " + strings.ReplaceAll(evt.Content, "\n", "\n  "))
+	case KindKeyRevocation:
+		if successor := get_successor(evt); successor != "" {
+			fmt.Printf("  The key is revoked. The stream continues under %s", showPubKey(successor))
+		} else {
+			fmt.Print("  The key is revoked. The stream is closed.")
+		}
+		if evt.Content != "" {
+			fmt.Printf("\n  Reason: %s", evt.Content)
+		}
+	case KindKeyLink:
+		fmt.Printf("  The stream continues under this key, taking over from %s", showPubKey(get_predecessor(evt)))
 	default:
 		fmt.Print(evt.Content)
 	}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// An append-only log of the events of a stream. Every line of the log file is a signed event
+// and every line of the index file is "<event id> <offset> <length>" pointing into the log.
+// Appending an event costs a single write to each file regardless of the stream size.
+// Events that change in place, e.g. when their attestation gets upgraded, are appended to the
+// patch file and replace the event with the same id when the log is read.
+type EventLog struct {
+	path       string
+	idx_path   string
+	patch_path string
+}
+
+// The log is rewritten with the patches applied once it has as many patches as events, but
+// not before it has this many
+const PATCHES_COMPACT_MIN = 64
+
+// Position of the log the stream file was last saved at. Anything in the log file or the
+// patch file past the checkpoint was written by a save that didn't complete.
+type Checkpoint struct {
+	Size        int    `json:"size"`
+	Head        string `json:"head"`
+	Offset      int64  `json:"offset"`
+	Patches     int    `json:"patches,omitempty"`
+	PatchOffset int64  `json:"patch_offset,omitempty"`
+}
+
+func openEventLog(pubkey string) *EventLog {
+	base_path, _ := homedir.Expand(STREAM_BASE_DIR)
+	path := filepath.Join(base_path, pubkey) + ".events"
+	return &EventLog{
+		path:       path + ".jsonl",
+		idx_path:   path + ".idx",
+		patch_path: path + ".patches.jsonl",
+	}
+}
+
+// Reads the events of the log up to the checkpoint and applies the patches. Events and patches
+// past it were written by a save that didn't complete and are left out. Without a checkpoint,
+// every complete event and patch is read.
+func (l *EventLog) ReadAll(cp *Checkpoint) ([]nostr.Event, error) {
+	var limit int64 = -1
+	if cp != nil {
+		limit = cp.Offset
+	}
+	result, err := readEvents(l.path, limit)
+	if errors.Is(err, os.ErrNotExist) && (cp == nil || cp.Size == 0) {
+		return []nostr.Event{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cp != nil && (len(result) != cp.Size || (cp.Size > 0 && result[cp.Size-1].ID != cp.Head)) {
+		return nil, fmt.Errorf("event log %s doesn't match its checkpoint", l.path)
+	}
+
+	if cp != nil {
+		limit = cp.PatchOffset
+	}
+	patches, err := readEvents(l.patch_path, limit)
+	if errors.Is(err, os.ErrNotExist) && (cp == nil || cp.Patches == 0) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cp != nil && len(patches) != cp.Patches {
+		return nil, fmt.Errorf("patches of event log %s don't match its checkpoint", l.path)
+	}
+	position := make(map[string]int, len(result))
+	for i := range result {
+		position[result[i].ID] = i
+	}
+	for _, ev := range patches {
+		i, ok := position[ev.ID]
+		if !ok && cp == nil {
+			continue
+		}
+		if !ok {
+			return nil, fmt.Errorf("event log %s has a patch for the unknown event %s", l.path, ev.ID)
+		}
+		result[i] = ev
+	}
+
+	return result, nil
+}
+
+// Appends events to the log that is expected to end at the checkpoint offset. Returns the
+// new checkpoint.
+func (l *EventLog) Append(cp Checkpoint, evs []nostr.Event) (*Checkpoint, error) {
+	if size := l.size(); size > cp.Offset {
+		// Drop what a save that didn't complete left past the checkpoint
+		if err := l.truncate(cp); err != nil {
+			return nil, err
+		}
+	} else if size != cp.Offset {
+		return nil, fmt.Errorf("event log %s doesn't end at the checkpoint", l.path)
+	}
+	if len(evs) == 0 {
+		return &cp, nil
+	}
+	lines, idx, err := encodeEvents(cp.Offset, evs)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendSync(l.path, lines); err != nil {
+		return nil, err
+	}
+	if err = appendSync(l.idx_path, idx); err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{
+		Size:   cp.Size + len(evs),
+		Head:   evs[len(evs)-1].ID,
+		Offset: cp.Offset + int64(len(lines)),
+	}, nil
+}
+
+// Appends new versions of events already in the log to the patch file that is expected to end
+// at the checkpoint patch offset. Returns the new checkpoint.
+func (l *EventLog) Patch(cp Checkpoint, evs []nostr.Event) (*Checkpoint, error) {
+	if size := fileSize(l.patch_path); size > cp.PatchOffset {
+		// Drop the patches a save that didn't complete left past the checkpoint
+		if err := os.Truncate(l.patch_path, cp.PatchOffset); err != nil {
+			return nil, err
+		}
+	} else if size != cp.PatchOffset {
+		return nil, fmt.Errorf("patches of event log %s don't end at the checkpoint", l.path)
+	}
+	if len(evs) == 0 {
+		return &cp, nil
+	}
+	lines, _, err := encodeEvents(cp.PatchOffset, evs)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendSync(l.patch_path, lines); err != nil {
+		return nil, err
+	}
+	cp.Patches += len(evs)
+	cp.PatchOffset += int64(len(lines))
+
+	return &cp, nil
+}
+
+// Whether rewriting the log to drop its patches is due
+func (cp *Checkpoint) NeedsCompaction() bool {
+	return cp.Patches >= PATCHES_COMPACT_MIN && cp.Patches >= cp.Size
+}
+
+// Replaces the whole log with the given events. Used to migrate streams stored in the old
+// format, when the log is not a continuation of what is stored and to compact the patches.
+func (l *EventLog) Rewrite(evs []nostr.Event) (*Checkpoint, error) {
+	lines, idx, err := encodeEvents(0, evs)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(l.path, 0600, func(w io.Writer) error {
+		_, err := w.Write(lines)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(l.idx_path, 0600, func(w io.Writer) error {
+		_, err := w.Write(idx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The events already carry their patches
+	if err = os.Remove(l.patch_path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	cp := &Checkpoint{Size: len(evs), Head: GENESIS, Offset: int64(len(lines))}
+	if len(evs) > 0 {
+		cp.Head = evs[len(evs)-1].ID
+	}
+	return cp, nil
+}
+
+// Finds a single event by its id without reading the whole log. A patched event is returned
+// in its latest version.
+func (l *EventLog) Lookup(id string) (*nostr.Event, error) {
+	if patches, err := readEvents(l.patch_path, -1); err == nil {
+		for i := len(patches) - 1; i >= 0; i-- {
+			if patches[i].ID == id {
+				return &patches[i], nil
+			}
+		}
+	}
+
+	idx, err := os.Open(l.idx_path)
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+
+	scanner := bufio.NewScanner(idx)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != id {
+			continue
+		}
+		offset, err1 := strconv.ParseInt(fields[1], 10, 64)
+		length, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("corrupted index entry for event %s", id)
+		}
+		return l.readAt(offset, length)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("event %s is not in the log", id)
+}
+
+func (l *EventLog) readAt(offset int64, length int64) (*nostr.Event, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, length)
+	if _, err = f.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	var ev nostr.Event
+	if err = json.Unmarshal(buf, &ev); err != nil {
+		return nil, err
+	}
+
+	return &ev, nil
+}
+
+// Cuts the log and its index back to the checkpoint
+func (l *EventLog) truncate(cp Checkpoint) error {
+	if err := os.Truncate(l.path, cp.Offset); err != nil {
+		return err
+	}
+	idx, err := os.ReadFile(l.idx_path)
+	if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(idx, []byte("\n"))
+	if len(lines) <= cp.Size {
+		return nil
+	}
+	return writeFileAtomic(l.idx_path, 0600, func(w io.Writer) error {
+		_, err := w.Write(bytes.Join(lines[:cp.Size], nil))
+		return err
+	})
+}
+
+func (l *EventLog) Remove() {
+	os.Remove(l.path)
+	os.Remove(l.idx_path)
+	os.Remove(l.patch_path)
+}
+
+func (l *EventLog) size() int64 {
+	return fileSize(l.path)
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Reads the complete events of a file of one event per line, up to limit bytes unless it's
+// negative
+func readEvents(path string, limit int64) ([]nostr.Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+	result := []nostr.Event{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var ev nostr.Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			// A torn write at the end of the file
+			break
+		}
+		result = append(result, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Encodes events as log lines and their index entries given the log offset they start at
+func encodeEvents(offset int64, evs []nostr.Event) ([]byte, []byte, error) {
+	lines := new(bytes.Buffer)
+	idx := new(bytes.Buffer)
+	for _, ev := range evs {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintf(idx, "%s %d %d\n", ev.ID, offset+int64(lines.Len()), len(line))
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+
+	return lines.Bytes(), idx.Bytes(), nil
+}
+
+func appendSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
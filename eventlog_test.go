@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func testEventLog(t *testing.T) *EventLog {
+	path := filepath.Join(t.TempDir(), "stream.events")
+	return &EventLog{path: path + ".jsonl", idx_path: path + ".idx", patch_path: path + ".patches.jsonl"}
+}
+
+// Upgraded events are patched in without rewriting the log
+func TestEventLogPatch(t *testing.T) {
+	l := testEventLog(t)
+	evs := []nostr.Event{}
+	for _, content := range []string{"one", "two", "three"} {
+		evs = append(evs, *newTestEvent(t, content))
+	}
+	cp, err := l.Append(Checkpoint{Head: GENESIS}, evs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log_size := l.size()
+
+	upgraded := evs[1]
+	upgraded.SetExtra("ots", "upgraded")
+	cp, err = l.Patch(*cp, []nostr.Event{upgraded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.size() != log_size || cp.Patches != 1 || cp.Size != 3 {
+		t.Fatalf("patching rewrote the log, checkpoint %+v", cp)
+	}
+	read, err := l.ReadAll(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 3 || read[1].GetExtraString("ots") != "upgraded" || read[0].GetExtraString("ots") != "" {
+		t.Fatalf("read %+v", read)
+	}
+	if ev, err := l.Lookup(evs[1].ID); err != nil || ev.GetExtraString("ots") != "upgraded" {
+		t.Fatalf("looked up %+v, %v", ev, err)
+	}
+
+	// A patch of a save that didn't complete is left out and dropped by the next one
+	again := upgraded
+	again.SetExtra("ots", "not saved")
+	if _, err = l.Patch(*cp, []nostr.Event{again}); err != nil {
+		t.Fatal(err)
+	}
+	if read, _ = l.ReadAll(cp); read[1].GetExtraString("ots") != "upgraded" {
+		t.Fatalf("read a patch past the checkpoint: %s", read[1].GetExtraString("ots"))
+	}
+	if _, err = l.Patch(*cp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fileSize(l.patch_path) != cp.PatchOffset {
+		t.Fatal("the patch past the checkpoint is still there")
+	}
+
+	// Rewriting applies the patches for good
+	read, _ = l.ReadAll(cp)
+	cp, err = l.Rewrite(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(l.patch_path); !os.IsNotExist(err) || cp.Patches != 0 {
+		t.Fatalf("patches left after the rewrite, checkpoint %+v", cp)
+	}
+	if read, err = l.ReadAll(cp); err != nil || read[1].GetExtraString("ots") != "upgraded" {
+		t.Fatalf("read %+v, %v", read, err)
+	}
+}
+
+func TestCheckpointNeedsCompaction(t *testing.T) {
+	tests := []struct {
+		cp   Checkpoint
+		want bool
+	}{
+		{Checkpoint{Size: 10, Patches: 10}, false},
+		{Checkpoint{Size: 10, Patches: PATCHES_COMPACT_MIN}, true},
+		{Checkpoint{Size: 1000, Patches: PATCHES_COMPACT_MIN}, false},
+		{Checkpoint{Size: 1000, Patches: 1000}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.cp.NeedsCompaction(); got != tt.want {
+			t.Errorf("%+v needs compaction: %v", tt.cp, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Two signed events of the same author that build on the same ancestor. A stream is a linear
+// chain, so this is proof that the author published two conflicting histories. The proof is
+// self-contained and can be verified without access to any relay.
+type ForkProof struct {
+	Ancestor string      `json:"ancestor"`
+	A        nostr.Event `json:"a"`
+	B        nostr.Event `json:"b"`
+}
+
+func newForkProof(a nostr.Event, b nostr.Event) ForkProof {
+	// Order the events so the same fork always gives the same proof
+	if b.ID < a.ID {
+		a, b = b, a
+	}
+	return ForkProof{Ancestor: get_prev(a), A: a, B: b}
+}
+
+func (p *ForkProof) PubKey() string {
+	return p.A.PubKey
+}
+
+// Checks the proof on its own, no stream or relay needed
+func (p *ForkProof) Verify() error {
+	if p.A.ID == p.B.ID {
+		return errors.New("both events are the same event")
+	}
+	for _, ev := range []nostr.Event{p.A, p.B} {
+		if ev.GetID() != ev.ID {
+			return fmt.Errorf("event id %s doesn't match its content", ev.ID)
+		}
+		if ok, _ := ev.CheckSignature(); !ok {
+			return fmt.Errorf("invalid signature for event %s", ev.ID)
+		}
+		if get_prev(ev) != p.Ancestor {
+			return fmt.Errorf("event %s doesn't build on %s", ev.ID, p.Ancestor)
+		}
+	}
+	if p.A.PubKey != p.B.PubKey {
+		return errors.New("events were signed by different keys")
+	}
+
+	return nil
+}
+
+func (p *ForkProof) Print() {
+	fmt.Printf("Fork at %s by %s\n", showEventID(p.Ancestor), showPubKey(p.PubKey()))
+	fmt.Printf("----------------------------------------------------------\n")
+	printEvent(p.A, nil, true)
+	fmt.Printf("\n----------------------------------------------------------\n")
+	printEvent(p.B, nil, true)
+	fmt.Printf("\n----------------------------------------------------------\n")
+}
+
+// Stores the proof on the stream. Returns false if we already had it.
+func (es *EventStream) AddForkProof(proof ForkProof) bool {
+	for _, known := range es.Forks {
+		if known.A.ID == proof.A.ID && known.B.ID == proof.B.ID {
+			return false
+		}
+	}
+	es.Forks = append(es.Forks, proof)
+	return true
+}
+
+// Finds an event of the stream that conflicts with the given event
+func (es *EventStream) findSibling(ev nostr.Event) *nostr.Event {
+	prev := get_prev(ev)
+	for _, evs := range [][]nostr.Event{es.Log, es.Side} {
+		for _, known := range evs {
+			if known.ID != ev.ID && known.PubKey == ev.PubKey && get_prev(known) == prev {
+				return &known
+			}
+		}
+	}
+	return nil
+}
+
+// Reads fork proofs from a file holding a single proof or a list of them
+func readForkProofs(path string) ([]ForkProof, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	proofs := []ForkProof{}
+	if err = json.Unmarshal(data, &proofs); err == nil {
+		return proofs, nil
+	}
+	var proof ForkProof
+	if err = json.Unmarshal(data, &proof); err != nil {
+		return nil, fmt.Errorf("can't parse fork proof: %w", err)
+	}
+
+	return []ForkProof{proof}, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Writes a file by writing a temporary file in the same directory and renaming it over the
+// target. A crash mid-write leaves either the old or the new content, never a truncated file.
+func writeFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp_path := tmp.Name()
+	// Remove the temporary file on failure. After a successful rename this is a noop.
+	defer os.Remove(tmp_path)
+
+	if err = write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp_path, path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// Atomically writes the indented json encoding of v to path
+func writeJSONAtomic(path string, perm os.FileMode, v any) error {
+	return writeFileAtomic(path, perm, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	})
+}
+
+// Flushes the directory entry so a rename survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Some filesystems don't support syncing directories, there's nothing we can do about it
+	d.Sync()
+
+	return nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	HEADERS_RPC             = "rpc"
+	HEADERS_ESPLORA         = "esplora"
+	HEADERS_BLOCKCHAIN_INFO = "blockchain.info"
+	HEADERS_FILE            = "file"
+	HEADERS_SPV             = "spv"
+)
+
+const (
+	DEFAULT_ESPLORA_URL         = "https://blockstream.info/api"
+	DEFAULT_BLOCKCHAIN_INFO_URL = "https://blockchain.info"
+)
+
+// Size of a serialized bitcoin block header
+const BLOCK_HEADER_SIZE = 80
+
+var ErrHeaderSourcesDisagree = errors.New("block header sources disagree")
+
+var headersClient = &http.Client{Timeout: 30 * time.Second}
+
+// The parts of a bitcoin block header we verify attestations against. Hashes are hex in the
+// byte order block explorers show them.
+type BlockHeader struct {
+	Height     uint64
+	Hash       string
+	MerkleRoot string
+	Time       time.Time
+}
+
+// Where block headers come from and how to reach them
+type HeaderSourceConfig struct {
+	Kind string `json:"kind"`
+	// Url of the api or path of the headers file
+	Location string `json:"location,omitempty"`
+}
+
+func (c *HeaderSourceConfig) String() string {
+	if c.Location == "" {
+		return c.Kind
+	}
+	return fmt.Sprintf("%s (%s)", c.Kind, c.Location)
+}
+
+func newHeaderSource(cfg *Config, sc *HeaderSourceConfig) (BlockHeaderSource, error) {
+	switch sc.Kind {
+	case HEADERS_RPC:
+		if cfg.BTCRPC == nil {
+			return nil, errors.New("no bitcoin rpc configured, set it with es ots rpc")
+		}
+		return &RPCHeaderSource{rpc: cfg.BTCRPC}, nil
+	case HEADERS_ESPLORA:
+		url := sc.Location
+		if url == "" {
+			url = cfg.GetNetwork().esplora
+		}
+		if url == "" {
+			return nil, fmt.Errorf("there's no public esplora api for %s, give the url of one", cfg.Network)
+		}
+		return &EsploraHeaderSource{url: strings.TrimSuffix(url, "/")}, nil
+	case HEADERS_BLOCKCHAIN_INFO:
+		if cfg.Network != NETWORK_MAINNET {
+			return nil, fmt.Errorf("blockchain.info only has mainnet blocks, the profile is on %s", cfg.Network)
+		}
+		url := sc.Location
+		if url == "" {
+			url = DEFAULT_BLOCKCHAIN_INFO_URL
+		}
+		return &BlockchainInfoHeaderSource{url: strings.TrimSuffix(url, "/")}, nil
+	case HEADERS_FILE:
+		if sc.Location == "" {
+			return nil, errors.New("the headers file source needs the path of the file")
+		}
+		return &HeadersFileSource{path: sc.Location}, nil
+	case HEADERS_SPV:
+		return openHeaderChain(cfg.DataDir, cfg.GetNetwork())
+	}
+
+	return nil, fmt.Errorf("unknown block header source: %s", sc.Kind)
+}
+
+// Headers from our own bitcoin node
+type RPCHeaderSource struct {
+	rpc *BTCRPCClient
+}
+
+func (s *RPCHeaderSource) Name() string {
+	return "bitcoin rpc " + s.rpc.Host
+}
+
+func (s *RPCHeaderSource) IsRemote() bool {
+	return false
+}
+
+func (s *RPCHeaderSource) HeaderAt(height uint64) (*BlockHeader, error) {
+	h, err := s.RawHeaderAt(height)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockHeader{Height: height, Hash: h.BlockHash().String(), MerkleRoot: h.MerkleRoot.String(), Time: h.Timestamp}, nil
+}
+
+func (s *RPCHeaderSource) RawHeaderAt(height uint64) (*wire.BlockHeader, error) {
+	conn, err := newBtcConn(s.rpc.Host, s.rpc.User, s.rpc.Password)
+	if err != nil {
+		return nil, fmt.Errorf("error creating btc connection: %v", err)
+	}
+	defer conn.Shutdown()
+	hash, err := conn.GetBlockHash(int64(height))
+	if err != nil {
+		return nil, err
+	}
+	return conn.GetBlockHeader(hash)
+}
+
+func (s *RPCHeaderSource) TipHeight() (uint64, error) {
+	conn, err := newBtcConn(s.rpc.Host, s.rpc.User, s.rpc.Password)
+	if err != nil {
+		return 0, fmt.Errorf("error creating btc connection: %v", err)
+	}
+	defer conn.Shutdown()
+	count, err := conn.GetBlockCount()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(count), nil
+}
+
+// Headers from an Esplora REST api, e.g. blockstream.info or mempool.space
+type EsploraHeaderSource struct {
+	url string
+}
+
+type esploraBlock struct {
+	ID         string `json:"id"`
+	Height     uint64 `json:"height"`
+	MerkleRoot string `json:"merkle_root"`
+	Timestamp  int64  `json:"timestamp"`
+	Version    int32  `json:"version"`
+	Bits       uint32 `json:"bits"`
+	Nonce      uint32 `json:"nonce"`
+	Prev       string `json:"previousblockhash"`
+}
+
+// Esplora lists this many blocks per request, from the height down
+const ESPLORA_BLOCKS_PER_PAGE = 10
+
+func (s *EsploraHeaderSource) Name() string {
+	return s.url
+}
+
+func (s *EsploraHeaderSource) IsRemote() bool {
+	return true
+}
+
+func (s *EsploraHeaderSource) HeaderAt(height uint64) (*BlockHeader, error) {
+	hash, err := httpGet(fmt.Sprintf("%s/block-height/%d", s.url, height))
+	if err != nil {
+		return nil, err
+	}
+	body, err := httpGet(fmt.Sprintf("%s/block/%s", s.url, strings.TrimSpace(string(hash))))
+	if err != nil {
+		return nil, err
+	}
+	var block esploraBlock
+	if err = json.Unmarshal(body, &block); err != nil {
+		return nil, fmt.Errorf("can't parse block %d from %s: %v", height, s.url, err)
+	}
+	if block.Height != height {
+		return nil, fmt.Errorf("%s returned block %d for height %d", s.url, block.Height, height)
+	}
+
+	return &BlockHeader{Height: height, Hash: block.ID, MerkleRoot: block.MerkleRoot, Time: time.Unix(block.Timestamp, 0)}, nil
+}
+
+func (s *EsploraHeaderSource) RawHeaderAt(height uint64) (*wire.BlockHeader, error) {
+	hash, err := httpGet(fmt.Sprintf("%s/block-height/%d", s.url, height))
+	if err != nil {
+		return nil, err
+	}
+	raw_hex, err := httpGet(fmt.Sprintf("%s/block/%s/header", s.url, strings.TrimSpace(string(hash))))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(raw_hex)))
+	if err != nil || len(raw) != BLOCK_HEADER_SIZE {
+		return nil, fmt.Errorf("%s returned an invalid header for block %d", s.url, height)
+	}
+	var h wire.BlockHeader
+	if err = h.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Fetches the headers of up to ESPLORA_BLOCKS_PER_PAGE blocks from the height on with a single
+// request. The headers are rebuilt from the listed fields and checked against the block ids.
+func (s *EsploraHeaderSource) RawHeadersFrom(height uint64, tip uint64) ([]wire.BlockHeader, error) {
+	last := height + ESPLORA_BLOCKS_PER_PAGE - 1
+	if last > tip {
+		last = tip
+	}
+	body, err := httpGet(fmt.Sprintf("%s/blocks/%d", s.url, last))
+	if err != nil {
+		return nil, err
+	}
+	var blocks []esploraBlock
+	if err = json.Unmarshal(body, &blocks); err != nil {
+		return nil, fmt.Errorf("can't parse blocks %d from %s: %v", last, s.url, err)
+	}
+	headers := make([]wire.BlockHeader, last-height+1)
+	found := 0
+	for _, block := range blocks {
+		if block.Height < height || block.Height > last {
+			continue
+		}
+		h, err := block.header()
+		if err != nil {
+			return nil, fmt.Errorf("%s returned an invalid header for block %d: %v", s.url, block.Height, err)
+		}
+		headers[block.Height-height] = *h
+		found++
+	}
+	if found != len(headers) {
+		return nil, fmt.Errorf("%s didn't return blocks %d to %d", s.url, height, last)
+	}
+
+	return headers, nil
+}
+
+func (b *esploraBlock) header() (*wire.BlockHeader, error) {
+	h := &wire.BlockHeader{
+		Version:   b.Version,
+		Timestamp: time.Unix(b.Timestamp, 0),
+		Bits:      b.Bits,
+		Nonce:     b.Nonce,
+	}
+	// The genesis block has no previous block
+	if b.Prev != "" {
+		prev, err := chainhash.NewHashFromStr(b.Prev)
+		if err != nil {
+			return nil, err
+		}
+		h.PrevBlock = *prev
+	}
+	merkle_root, err := chainhash.NewHashFromStr(b.MerkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	h.MerkleRoot = *merkle_root
+	if h.BlockHash().String() != b.ID {
+		return nil, fmt.Errorf("the fields don't hash to %s", b.ID)
+	}
+	return h, nil
+}
+
+func (s *EsploraHeaderSource) TipHeight() (uint64, error) {
+	body, err := httpGet(s.url + "/blocks/tip/height")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(body)), 10, 64)
+}
+
+// The response of blockchain.info request
+type BlockchainInfoResp struct {
+	Blocks []BlocksResp `json:"blocks"`
+}
+type BlocksResp struct {
+	Hash       string `json:"hash"`
+	MerkleRoot string `json:"mrkl_root"`
+	Timestamp  int    `json:"time"`
+	MainChain  bool   `json:"main_chain"`
+}
+
+// Headers from the blockchain.info api
+type BlockchainInfoHeaderSource struct {
+	url string
+}
+
+func (s *BlockchainInfoHeaderSource) Name() string {
+	return s.url
+}
+
+func (s *BlockchainInfoHeaderSource) IsRemote() bool {
+	return true
+}
+
+func (s *BlockchainInfoHeaderSource) HeaderAt(height uint64) (*BlockHeader, error) {
+	body, err := httpGet(fmt.Sprintf("%s/block-height/%d?format=json", s.url, height))
+	if err != nil {
+		return nil, err
+	}
+	var result BlockchainInfoResp
+	if err = json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("can't parse block %d from %s: %v", height, s.url, err)
+	}
+	// Stale blocks at the same height are listed too
+	for _, block := range result.Blocks {
+		if block.MainChain || len(result.Blocks) == 1 {
+			return &BlockHeader{Height: height, Hash: block.Hash, MerkleRoot: block.MerkleRoot, Time: time.Unix(int64(block.Timestamp), 0)}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s has no block at height %d", s.url, height)
+}
+
+// Headers from a file of raw 80 byte headers, starting with the genesis block
+type HeadersFileSource struct {
+	path string
+}
+
+func (s *HeadersFileSource) Name() string {
+	return s.path
+}
+
+func (s *HeadersFileSource) IsRemote() bool {
+	return false
+}
+
+func (s *HeadersFileSource) HeaderAt(height uint64) (*BlockHeader, error) {
+	h, err := s.RawHeaderAt(height)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockHeader{Height: height, Hash: h.BlockHash().String(), MerkleRoot: h.MerkleRoot.String(), Time: h.Timestamp}, nil
+}
+
+func (s *HeadersFileSource) RawHeaderAt(height uint64) (*wire.BlockHeader, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	raw := make([]byte, BLOCK_HEADER_SIZE)
+	if _, err = f.ReadAt(raw, int64(height)*BLOCK_HEADER_SIZE); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("headers file %s ends before block %d", s.path, height)
+		}
+		return nil, err
+	}
+	var h wire.BlockHeader
+	if err = h.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (s *HeadersFileSource) TipHeight() (uint64, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < BLOCK_HEADER_SIZE {
+		return 0, fmt.Errorf("headers file %s is empty", s.path)
+	}
+	return uint64(info.Size()/BLOCK_HEADER_SIZE) - 1, nil
+}
+
+// Stands in when no block header source could be set up, verifying then says why
+type MissingHeaderSource struct {
+	err error
+}
+
+func (s *MissingHeaderSource) Name() string {
+	return "no block header source"
+}
+
+func (s *MissingHeaderSource) IsRemote() bool {
+	return true
+}
+
+func (s *MissingHeaderSource) HeaderAt(height uint64) (*BlockHeader, error) {
+	return nil, s.err
+}
+
+func httpGet(url string) ([]byte, error) {
+	res, err := headersClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s replied %s: %s", url, res.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Serves the blocks the way Esplora and blockchain.info do. blockchain.info also lists a
+// stale block at every height but the genesis.
+func headersAPIStandIn(headers []wire.BlockHeader) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/esplora/block-height/", func(w http.ResponseWriter, r *http.Request) {
+		height, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/esplora/block-height/"))
+		if err != nil || height >= len(headers) {
+			http.Error(w, "Block not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, headers[height].BlockHash().String())
+	})
+	mux.HandleFunc("/esplora/block/", func(w http.ResponseWriter, r *http.Request) {
+		hash := strings.TrimPrefix(r.URL.Path, "/esplora/block/")
+		for height, h := range headers {
+			if h.BlockHash().String() == hash {
+				json.NewEncoder(w).Encode(esploraBlock{
+					ID:         hash,
+					Height:     uint64(height),
+					MerkleRoot: h.MerkleRoot.String(),
+					Timestamp:  h.Timestamp.Unix(),
+				})
+				return
+			}
+		}
+		http.Error(w, "Block not found", http.StatusNotFound)
+	})
+	mux.HandleFunc("/blockchain.info/block-height/", func(w http.ResponseWriter, r *http.Request) {
+		height, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/blockchain.info/block-height/"))
+		if err != nil || height >= len(headers) {
+			http.Error(w, "Unknown Error Fetching Blocks From Database", http.StatusInternalServerError)
+			return
+		}
+		h := headers[height]
+		resp := BlockchainInfoResp{}
+		if height > 0 {
+			resp.Blocks = append(resp.Blocks, BlocksResp{Hash: fmt.Sprintf("%064x", height), MerkleRoot: fmt.Sprintf("%064x", height), Timestamp: int(h.Timestamp.Unix())})
+		}
+		resp.Blocks = append(resp.Blocks, BlocksResp{Hash: h.BlockHash().String(), MerkleRoot: h.MerkleRoot.String(), Timestamp: int(h.Timestamp.Unix()), MainChain: true})
+		json.NewEncoder(w).Encode(resp)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestHeaderSources(t *testing.T) {
+	mainnet := parseHeaders(t, mainnetHeaders)
+	srv := headersAPIStandIn(mainnet)
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "headers.dat")
+	raw := new(bytes.Buffer)
+	for _, h := range mainnet {
+		h.Serialize(raw)
+	}
+	if err := os.WriteFile(path, raw.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := openHeaderChain(t.TempDir(), networks[NETWORK_MAINNET])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range mainnet {
+		if err = chain.connect(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sources := []BlockHeaderSource{
+		&EsploraHeaderSource{url: srv.URL + "/esplora"},
+		&BlockchainInfoHeaderSource{url: srv.URL + "/blockchain.info"},
+		&HeadersFileSource{path: path},
+		chain,
+	}
+	for _, src := range sources {
+		t.Run(fmt.Sprintf("%T", src), func(t *testing.T) {
+			for height, h := range mainnet {
+				header, err := src.HeaderAt(uint64(height))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if header.Height != uint64(height) || header.Hash != h.BlockHash().String() ||
+					header.MerkleRoot != h.MerkleRoot.String() || !header.Time.Equal(h.Timestamp) {
+					t.Fatalf("block %d is %+v", height, header)
+				}
+			}
+			if _, err := src.HeaderAt(uint64(len(mainnet))); err == nil {
+				t.Fatal("got a block past the tip")
+			}
+		})
+	}
+}
+
+func TestCrossCheckedHeaders(t *testing.T) {
+	c := newCalendarStandIn()
+	defer c.Close()
+	headers := newTestHeaders()
+	ev := newTestEvent(t, "hello")
+	stamping := newTestOTS(headers, 1, c)
+	stamp, err := stamping.Stamp(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block_time := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.confirm(headers, 770000, block_time)
+	ev.SetExtra("ots", stamp)
+	// Verifying the complete proof needs no calendar
+	if _, err = stamping.Upgrade(ev); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	same := &testHeaders{blocks: map[uint64]*BlockHeader{}}
+	for height, h := range headers.blocks {
+		same.blocks[height] = h
+	}
+
+	tests := []struct {
+		name   string
+		block  *BlockHeader
+		status string
+		err    string
+	}{
+		{"agree", same.blocks[770000], OTS_STATUS_OK, ""},
+		{"another hash", &BlockHeader{Height: 770000, Hash: fmt.Sprintf("%064x", 1), MerkleRoot: same.blocks[770000].MerkleRoot, Time: block_time}, OTS_STATUS_INVALID, "disagree on block 770000"},
+		{"another time", &BlockHeader{Height: 770000, Hash: same.blocks[770000].Hash, MerkleRoot: same.blocks[770000].MerkleRoot, Time: block_time.Add(time.Hour)}, OTS_STATUS_INVALID, "disagree on block 770000"},
+		{"missing block", nil, OTS_STATUS_UNVERIFIABLE, "can't cross-check block 770000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := &testHeaders{blocks: map[uint64]*BlockHeader{0: same.blocks[0]}}
+			if tt.block != nil {
+				other.blocks[770000] = tt.block
+			}
+			ots := newTestOTS(headers, 1)
+			ots.cross_check = other
+			r := ots.VerifyEvent(ev)
+			if r.Status != tt.status || (tt.err != "" && !strings.Contains(r.Error, tt.err)) {
+				t.Fatalf("verified as %s: %s", r.Status, r.Error)
+			}
+			if tt.err == "" && r.Source != "test headers and test headers" {
+				t.Fatalf("verified with %s", r.Source)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+)
+
+// A journal is an append-only sidecar of a stream file. Every change to the stream metadata
+// is appended to it before the stream file gets replaced, so a stream file that got corrupted
+// can be rebuilt from the journal and the event log. Once the stream file is written the
+// journal is compacted, so it normally holds a single record.
+type StreamJournal struct {
+	path string
+	// Size of the journal file after the last read or write. If another process appended to
+	// the journal in the meantime, the size won't match and the journal has to be reopened.
+	size int64
+	// Last stream metadata written to the journal
+	meta *EventStream
+	// Number of records in the journal
+	records int
+}
+
+// A single line in the journal
+type JournalRecord struct {
+	// Stream metadata i.e. everything except the log
+	Meta *EventStream `json:"meta,omitempty"`
+}
+
+// Opens the journal and reads the last metadata it holds
+func openJournal(path string) (*StreamJournal, error) {
+	j := &StreamJournal{path: path}
+	err := j.replay(func(rec JournalRecord) {
+		if rec.Meta != nil {
+			j.meta = rec.Meta
+		}
+		j.records++
+	})
+	if err != nil {
+		return nil, err
+	}
+	j.size = journalSize(path)
+
+	return j, nil
+}
+
+// Checks whether the journal file was changed since we last read or wrote it
+func (j *StreamJournal) IsStale() bool {
+	return journalSize(j.path) != j.size
+}
+
+// Appends the stream metadata to the journal if it changed since the last write. The MMR
+// is left out, it's rebuilt from the event log on recovery.
+func (j *StreamJournal) Write(es *EventStream) error {
+	meta := streamMeta(es)
+	meta.MMR = nil
+	if j.meta != nil && reflect.DeepEqual(*j.meta, *meta) {
+		return nil
+	}
+	line, err := json.Marshal(JournalRecord{Meta: meta})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if j.meta != nil && j.meta.PrivKey != meta.PrivKey {
+		// The key changed (e.g. it got encrypted). Start over so the old key doesn't linger.
+		err = j.rewrite(line)
+	} else {
+		err = appendSync(j.path, line)
+		j.records++
+	}
+	if err != nil {
+		return fmt.Errorf("can't write journal %s: %w", j.path, err)
+	}
+	j.size = journalSize(j.path)
+	j.meta = meta
+
+	return nil
+}
+
+// Shrinks the journal to its last record. Called once the stream file holds what the
+// journal has, the older records aren't needed to recover it anymore.
+func (j *StreamJournal) Compact() error {
+	if j.records <= 1 {
+		return nil
+	}
+	line, err := json.Marshal(JournalRecord{Meta: j.meta})
+	if err != nil {
+		return err
+	}
+	if err = j.rewrite(append(line, '\n')); err != nil {
+		return fmt.Errorf("can't compact journal %s: %w", j.path, err)
+	}
+	j.size = journalSize(j.path)
+
+	return nil
+}
+
+func (j *StreamJournal) rewrite(line []byte) error {
+	err := writeFileAtomic(j.path, 0600, func(w io.Writer) error {
+		_, err := w.Write(line)
+		return err
+	})
+	if err == nil {
+		j.records = 1
+	}
+	return err
+}
+
+// Returns the last stream metadata written to the journal
+func (j *StreamJournal) Recover() (*EventStream, error) {
+	if j.meta == nil {
+		return nil, fmt.Errorf("journal %s holds no stream metadata", j.path)
+	}
+	meta := *j.meta
+	return &meta, nil
+}
+
+// Calls f for every complete record in the journal. A torn last line, left by a crash
+// in the middle of an append, is ignored.
+func (j *StreamJournal) replay(f func(JournalRecord)) error {
+	file, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec JournalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			break
+		}
+		f(rec)
+	}
+
+	return scanner.Err()
+}
+
+func journalSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Copy of the stream without the log
+func streamMeta(es *EventStream) *EventStream {
+	meta := *es
+	meta.Log = nil
+	meta.modified = nil
+	meta.unloaded = nil
+	return &meta
+}
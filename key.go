@@ -1,21 +1,39 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 
 	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/tyler-smith/go-bip32"
 
 	"github.com/nbd-wtf/go-nostr/nip06"
 )
 
+// How the private key of a stream was derived. A stream either comes from the seed words at
+// a NIP-06 path or from the private key of a parent stream and a label. Either way, the key
+// can be derived again from the seed words alone.
+type Derivation struct {
+	// NIP-06 path of a key derived from the seed words, e.g. m/44'/1237'/0'/0/0
+	Path string `json:"path,omitempty"`
+	// Pubkey of the parent stream whose private key was hashed with the label
+	Parent string `json:"parent,omitempty"`
+	Label  string `json:"label,omitempty"`
+}
+
 func getPubKey(privateKey string) string {
 	if keyb, err := hex.DecodeString(privateKey); err != nil {
 		log.Printf("Error decoding key from hex: %s\n", err.Error())
 		return ""
 	} else {
 		_, pubkey := btcec.PrivKeyFromBytes(keyb)
-		return hex.EncodeToString(pubkey.X().Bytes())
+		// Keeps the leading zeros of the x coordinate
+		return hex.EncodeToString(schnorr.SerializePubKey(pubkey))
 	}
 }
 
@@ -26,8 +44,7 @@ func keyGen() (string, string, error) {
 		return "", "", err
 	}
 
-	seed := nip06.SeedFromWords(seedWords)
-	sk, err := nip06.PrivateKeyFromSeed(seed)
+	sk, err := keyFromSeed(seedWords, 0)
 	if err != nil {
 		log.Println(err)
 		return "", "", err
@@ -35,3 +52,55 @@ func keyGen() (string, string, error) {
 
 	return seedWords, sk, nil
 }
+
+func seedPath(account uint32) string {
+	return fmt.Sprintf("m/44'/1237'/%d'/0/0", account)
+}
+
+// Derives the private key of a NIP-06 account from the seed words. Account 0 is the key
+// every nostr client derives from the same words.
+func keyFromSeed(words string, account uint32) (string, error) {
+	// Extra whitespace would give a different seed
+	words = strings.Join(strings.Fields(words), " ")
+	if !nip06.ValidateWords(words) {
+		return "", errors.New("invalid seed words")
+	}
+	key, err := bip32.NewMasterKey(nip06.SeedFromWords(words))
+	if err != nil {
+		return "", err
+	}
+	path := []uint32{
+		bip32.FirstHardenedChild + 44,
+		bip32.FirstHardenedChild + 1237,
+		bip32.FirstHardenedChild + account,
+		0,
+		0,
+	}
+	for _, idx := range path {
+		key, err = key.NewChildKey(idx)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(key.Key), nil
+}
+
+// Derives the private key of a child stream as H(parent_priv || label)
+func deriveChildKey(parent_priv string, label string) (string, error) {
+	parent_bytes, err := hex.DecodeString(parent_priv)
+	if err != nil || len(parent_bytes) != 32 {
+		return "", errors.New("parent private key must be 32 bytes of hex")
+	}
+	if label == "" {
+		return "", errors.New("derivation label can't be empty")
+	}
+	h := sha256.Sum256(append(parent_bytes, []byte(label)...))
+	// Practically impossible, but a hash outside the curve order is not a valid key
+	var scalar btcec.ModNScalar
+	if overflow := scalar.SetByteSlice(h[:]); overflow || scalar.IsZero() {
+		return "", fmt.Errorf("label %s doesn't give a valid key, pick another one", label)
+	}
+
+	return hex.EncodeToString(h[:]), nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// One key in 256 has a pubkey that starts with a zero byte
+func TestPubKeyKeepsLeadingZeros(t *testing.T) {
+	found := 0
+	for i := 1; found < 2; i++ {
+		priv_key := fmt.Sprintf("%064x", i)
+		pubkey := getPubKey(priv_key)
+		want, _ := nostr.GetPublicKey(priv_key)
+		if pubkey != want || len(pubkey) != 64 {
+			t.Fatalf("pubkey of %s is %s, want %s", priv_key, pubkey, want)
+		}
+		if pubkey[:2] == "00" {
+			found++
+		}
+	}
+}
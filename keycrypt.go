@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Private keys are encrypted at rest following NIP-49. The encrypted key is the bech32
+// encoding (with the "ncryptsec" prefix) of
+// VERSION (1) || LOG_N (1) || SALT (16) || NONCE (24) || KEY_SECURITY (1) || CIPHERTEXT (48)
+const (
+	NCRYPTSEC_PREFIX  = "ncryptsec"
+	ncryptsecVersion  = 0x02
+	ncryptsecLogN     = 16
+	ncryptsecSaltSize = 16
+	// We don't know whether the key was handled insecurely before it was encrypted
+	ncryptsecKeySecurity = 0x02
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted encrypted key")
+
+func isEncryptedKey(key string) bool {
+	return strings.HasPrefix(key, NCRYPTSEC_PREFIX+"1")
+}
+
+// Encrypts a hex private key with the passphrase and returns the ncryptsec string
+func encryptPrivKey(priv_key string, passphrase string) (string, error) {
+	key_bytes, err := hex.DecodeString(priv_key)
+	if err != nil || len(key_bytes) != 32 {
+		return "", errors.New("private key must be 32 bytes of hex")
+	}
+	salt := make([]byte, ncryptsecSaltSize)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err = rand.Read(salt); err != nil {
+		return "", err
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	aead, err := ncryptsecCipher(passphrase, salt, ncryptsecLogN)
+	if err != nil {
+		return "", err
+	}
+	ad := []byte{ncryptsecKeySecurity}
+	ciphertext := aead.Seal(nil, nonce, key_bytes, ad)
+
+	data := []byte{ncryptsecVersion, ncryptsecLogN}
+	data = append(data, salt...)
+	data = append(data, nonce...)
+	data = append(data, ad...)
+	data = append(data, ciphertext...)
+	conv, err := bech32.ConvertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+
+	return bech32.Encode(NCRYPTSEC_PREFIX, conv)
+}
+
+// Decrypts an ncryptsec string and returns the hex private key
+func decryptPrivKey(ncryptsec string, passphrase string) (string, error) {
+	prefix, conv, err := bech32.DecodeNoLimit(ncryptsec)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted key: %w", err)
+	}
+	if prefix != NCRYPTSEC_PREFIX {
+		return "", fmt.Errorf("invalid encrypted key prefix: %s", prefix)
+	}
+	data, err := bech32.ConvertBits(conv, 5, 8, false)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted key: %w", err)
+	}
+	nonce_size := chacha20poly1305.NonceSizeX
+	if len(data) != 2+ncryptsecSaltSize+nonce_size+1+48 {
+		return "", errors.New("invalid encrypted key length")
+	}
+	if data[0] != ncryptsecVersion {
+		return "", fmt.Errorf("unsupported encrypted key version: %d", data[0])
+	}
+	log_n := data[1]
+	salt := data[2 : 2+ncryptsecSaltSize]
+	nonce := data[2+ncryptsecSaltSize : 2+ncryptsecSaltSize+nonce_size]
+	ad := data[2+ncryptsecSaltSize+nonce_size : 3+ncryptsecSaltSize+nonce_size]
+	ciphertext := data[3+ncryptsecSaltSize+nonce_size:]
+
+	aead, err := ncryptsecCipher(passphrase, salt, log_n)
+	if err != nil {
+		return "", err
+	}
+	key_bytes, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return "", ErrWrongPassphrase
+	}
+
+	return hex.EncodeToString(key_bytes), nil
+}
+
+func ncryptsecCipher(passphrase string, salt []byte, log_n byte) (cipher.AEAD, error) {
+	if log_n > 22 {
+		return nil, fmt.Errorf("encrypted key asks for too much memory (log_n=%d)", log_n)
+	}
+	// Passphrases are unicode normalized so the same passphrase typed on a different
+	// system decrypts the key
+	normalized := norm.NFKC.String(passphrase)
+	key, err := scrypt.Key([]byte(normalized), salt, 1<<log_n, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.NewX(key)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The test vector of NIP-49
+const nip49Ncryptsec = "ncryptsec1qgg9947rlpvqu76pj5ecreduf9jxhselq2nae2kghhvd5g7dgjtcxfqtd67p9m0w57lspw8gsq6yphnm8623nsl8xn9j4jdzz84zm3frztj3z7s35vpzmqf6ksu8r89qk5z2zxfmu5gv8th8wclt0h4p"
+const nip49PrivKey = "3501454135014541350145413501453fefb02227e449e57cf4d3a3ce05378683"
+
+func TestDecryptPrivKey(t *testing.T) {
+	// A changed character breaks the bech32 checksum
+	tampered := nip49Ncryptsec[:20] + "q" + nip49Ncryptsec[21:]
+
+	tests := []struct {
+		name       string
+		ncryptsec  string
+		passphrase string
+		want       string
+		err        string
+	}{
+		{"nip-49 vector", nip49Ncryptsec, "nostr", nip49PrivKey, ""},
+		{"wrong passphrase", nip49Ncryptsec, "nostr!", "", ErrWrongPassphrase.Error()},
+		{"tampered", tampered, "nostr", "", "invalid encrypted key"},
+		{"not encrypted", "nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5", "nostr", "", "invalid encrypted key prefix"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptPrivKey(tt.ncryptsec, tt.passphrase)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptPrivKeyRoundTrip(t *testing.T) {
+	ncryptsec, err := encryptPrivKey(nip49PrivKey, "nostr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedKey(ncryptsec) || isEncryptedKey(nip49PrivKey) {
+		t.Fatal("can't tell encrypted keys apart")
+	}
+	// A fresh salt and nonce every time
+	if again, _ := encryptPrivKey(nip49PrivKey, "nostr"); again == ncryptsec {
+		t.Fatal("encrypting twice gave the same result")
+	}
+	got, err := decryptPrivKey(ncryptsec, "nostr")
+	if err != nil || got != nip49PrivKey {
+		t.Fatalf("got %s: %v", got, err)
+	}
+	if _, err = encryptPrivKey("abcd", "nostr"); err == nil {
+		t.Fatal("encrypted a key that's too short")
+	}
+}
+
+// NIP-49 normalizes passphrases to NFKC, so the same passphrase in another unicode form
+// decrypts the key
+func TestPassphraseNormalization(t *testing.T) {
+	decomposed := "ÅΩẛ̣"
+	if got := hex.EncodeToString([]byte(norm.NFKC.String(decomposed))); got != "c385cea9e1b9a9" {
+		t.Fatalf("normalized to %s", got)
+	}
+	ncryptsec, err := encryptPrivKey(nip49PrivKey, decomposed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decryptPrivKey(ncryptsec, "ÅΩṩ")
+	if err != nil || got != nip49PrivKey {
+		t.Fatalf("got %s: %v", got, err)
+	}
+	if _, err = decryptPrivKey(ncryptsec, "ÅΩ"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("got %v, want %v", err, ErrWrongPassphrase)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const LOCK_FILE = ".lock"
+
+// An advisory lock on the data directory. Every es process that reads and writes
+// event streams takes it so concurrent commands don't clobber each other's changes.
+type DataDirLock struct {
+	f *os.File
+}
+
+// Blocks until the lock on the data directory is acquired
+func lockDataDir(dir string) (*DataDirLock, error) {
+	path := filepath.Join(dir, LOCK_FILE)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open lock file %s: %w", path, err)
+	}
+	if err = flock(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("can't lock %s: %w", path, err)
+	}
+
+	return &DataDirLock{f: f}, nil
+}
+
+func (l *DataDirLock) Unlock() {
+	if l == nil || l.f == nil {
+		return
+	}
+	funlock(l.f)
+	l.f.Close()
+	l.f = nil
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Advisory locking is not supported on windows, concurrent commands are not protected
+func flock(f *os.File) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
@@ -1,24 +1,31 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"time"
 
 	"github.com/docopt/docopt-go"
+	"github.com/nbd-wtf/go-nostr"
 )
 
 const USAGE = `es
 
 Usage:
   es world
-  es create <name> <privkey>
   es create <name> [--gen]
+  es create <name> --import
+  es create <name> --from=<parent> [--label=<label>]
+  es create <name> --index=<n>
   es remove <name>
+  es restore <name> [--index=<n>] [--relay=<url>...]
   es switch <name>
   es ll [-a]
-  es append <content>
+  es append <content>...
   es follow <name> <pubkey>
   es unfollow <name>
   es sync <name>
@@ -28,14 +35,52 @@ Usage:
   es log [--name=<name>]
   es show <id> [--verbose]
   es ots upgrade <name>
-  es ots verify <name>
+  es ots watch [--interval=<interval>]
+  es ots verify <name> [--format=<format>]
+  es ots info <id>
   es ots rpc <url> <user> <password>
   es ots norpc
+  es ots headers
+  es ots headers <source> [<location>]
+  es ots crosscheck <source> [<location>]
+  es ots calendar
+  es ots calendar add <url>
+  es ots calendar remove <url>
+  es ots quorum <n>
+  es ots slack [<duration>]
   es relay
   es relay add <url>
   es relay remove <url>
+  es backend <backend>
+  es display <format>
+  es fork-policy <policy>
+  es profile
+  es profile add <name> [--network=<network>]
+  es profile switch <name>
+  es profile remove <name>
+  es key encrypt <name>
+  es forks <name> [--json]
+  es proof <id>
+  es verify-proof <file> [--root=<root>]
+  es verify-fork <file>
+  es verify <name> [--json] [--no-ots]
+  es export <name> --out=<file>
+  es import <file> [--name=<name>]
+  es headers
+  es headers import <file>
+  es headers update [<source> [<location>]]
+  es verify --all [--json] [--no-ots]
+  es revoke <name> [--reason=<reason>]
+  es rotate <name> [--reason=<reason>]
+  es agent [--ttl=<ttl>]
+  es agent add <name> [--ttl=<ttl>]
+  es agent lock
+  es signer connect <name> <bunker>
+  es signer local <name>
+  es signer serve <name> [--relay=<url>...] [--new-secret]
 
-All pubkeys passed should *NOT* be bech32 encoded.
+Pubkeys, private keys and event ids can be given as hex or bech32 (npub, nsec, note,
+nprofile, nevent).
 `
 
 // Fails if we have no active event stream (required for appending etc.)
@@ -69,17 +114,90 @@ func main() {
 		fmt.Println(err.Error())
 		return
 	}
+	// Long running commands and the ones that wait on relays, calendars or a remote signer take
+	// the data directory lock only while they read and write the streams
+	is_agent := opts["agent"].(bool) && !opts["add"].(bool) && !opts["lock"].(bool)
+	is_watch := opts["ots"].(bool) && opts["watch"].(bool)
+	is_network := opts["sync"].(bool) || opts["append"].(bool) || opts["follow"].(bool) ||
+		opts["verify"].(bool) || (opts["ots"].(bool) && opts["upgrade"].(bool))
+	if !opts["world"].(bool) && !is_agent && !is_watch && !is_network {
+		srv.Lock()
+		defer srv.Unlock()
+	}
 
 	// Event stream auth commands - don't require an active event stream set
 	switch {
+	case opts["profile"].(bool):
+		var err error
+		switch {
+		case opts["add"].(bool):
+			network := NETWORK_MAINNET
+			if val, _ := opts["--network"]; val != nil {
+				network = val.(string)
+			}
+			err = srv.config.AddProfile(opts["<name>"].(string), network)
+		case opts["switch"].(bool):
+			err = srv.config.SwitchProfile(opts["<name>"].(string))
+		case opts["remove"].(bool):
+			err = srv.config.RemoveProfile(opts["<name>"].(string))
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		names := []string{srv.config.ActiveProfile}
+		for name := range srv.config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if name == srv.config.ActiveProfile {
+				fmt.Printf("* %s (%s)\n", name, srv.config.Network)
+			} else {
+				fmt.Printf("  %s (%s)\n", name, srv.config.Profiles[name].Network)
+			}
+		}
+		return
 	case opts["create"].(bool):
-		// TODO: make this read from stdin and encrypt private key in jsons
 		name := opts["<name>"].(string)
-		priv_key, _ := opts.String("<privkey>")
 		generate, _ := opts.Bool("--gen")
-		srv.store.CreateEventStream(name, priv_key, generate)
+		priv_key := ""
+		var derivation *Derivation
+		switch {
+		case opts["--import"].(bool):
+			// Read the key from the terminal or stdin so it doesn't end up in the shell history
+			priv_key, err = readSecret("Private key: ", false)
+			if err == nil {
+				priv_key, err = parsePrivKey(priv_key)
+			}
+		case opts["--from"] != nil:
+			// Child streams default to their own name as the label
+			label := name
+			if opts["--label"] != nil {
+				label = opts["--label"].(string)
+			}
+			priv_key, derivation, err = srv.DeriveKey(opts["--from"].(string), label)
+		case opts["--index"] != nil:
+			var account int
+			account, err = opts.Int("--index")
+			if err != nil || account < 0 {
+				log.Println("--index must be a non-negative number")
+				return
+			}
+			var words string
+			words, err = readSecret("Seed words: ", false)
+			if err == nil {
+				priv_key, err = keyFromSeed(words, uint32(account))
+				derivation = &Derivation{Path: seedPath(uint32(account))}
+			}
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		srv.store.CreateEventStream(name, priv_key, generate, derivation)
 	// We have to check that the "remove" option is not called with "es relay remove"
-	case opts["remove"].(bool) && !opts["relay"].(bool):
+	case opts["remove"].(bool) && !opts["relay"].(bool) && !opts["ots"].(bool):
 		name := opts["<name>"].(string)
 		srv.store.RemoveEventStream(name)
 		fmt.Printf("Removed %s stream.", name)
@@ -90,6 +208,546 @@ func main() {
 		require_active(srv.store)
 		all, _ := opts.Bool("-a")
 		srv.store.ListEventStreams(all)
+	case opts["key"].(bool):
+		name := opts["<name>"].(string)
+		pubkey, err := srv.store.GetPubForName(name)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		es, err := srv.store.GetEventStream(pubkey)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		passphrase, err := readPassphrase(fmt.Sprintf("New passphrase for %s: ", name), true)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		err = es.EncryptPrivKey(passphrase)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		srv.store.SaveEventStream(es)
+		fmt.Printf("Encrypted the private key of %s.\n", name)
+		return
+	case opts["agent"].(bool):
+		agent := &AgentClient{path: agentSocketPath(srv.config)}
+		ttl := DEFAULT_AGENT_TTL
+		if val, _ := opts["--ttl"]; val != nil {
+			ttl, err = time.ParseDuration(val.(string))
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+		}
+		switch {
+		case opts["add"].(bool):
+			name := opts["<name>"].(string)
+			pubkey, err := srv.store.GetPubForName(name)
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+			es, err := srv.store.GetEventStream(pubkey)
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+			if es.PrivKey == "" {
+				log.Printf("%s has no private key, we merely follow it", name)
+				return
+			}
+			priv_key, err := es.UnlockPrivKey()
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+			err = agent.Add(priv_key, ttl)
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+			fmt.Printf("The agent holds the key of %s for %s.\n", name, ttl)
+		case opts["lock"].(bool):
+			err := agent.Lock()
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+			fmt.Println("The agent forgot all keys.")
+		default:
+			err := runAgent(srv.config, ttl)
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}
+		return
+	case opts["signer"].(bool):
+		name := opts["<name>"].(string)
+		pubkey, err := srv.store.GetPubForName(name)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		es, err := srv.store.GetEventStream(pubkey)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		switch {
+		case opts["connect"].(bool):
+			cfg, err := parseBunkerURL(opts["<bunker>"].(string))
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+			es.RemoteSigner = cfg
+			srv.store.SaveEventStream(es)
+			fmt.Printf("Events of %s are now signed by the remote signer.\n", name)
+		case opts["local"].(bool):
+			es.RemoteSigner = nil
+			srv.store.SaveEventStream(es)
+			fmt.Printf("Events of %s are now signed locally.\n", name)
+		case opts["serve"].(bool):
+			relays := opts["--relay"].([]string)
+			if len(relays) == 0 {
+				relays = es.ListRelays()
+			}
+			// Clients keep presenting the secret they connected with, so it stays the same
+			// across restarts until we ask for a new one
+			if new_secret, _ := opts.Bool("--new-secret"); new_secret || es.BunkerSecret == "" {
+				es.BunkerSecret = randomHex(16)
+				if err = srv.store.SaveEventStream(es); err != nil {
+					log.Println(err.Error())
+					return
+				}
+			}
+			// The signer runs until interrupted, don't block other commands meanwhile
+			srv.Unlock()
+			err := runBunker(es, relays)
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}
+		return
+	case opts["restore"].(bool):
+		name := opts["<name>"].(string)
+		account := 0
+		if opts["--index"] != nil {
+			account, err = opts.Int("--index")
+			if err != nil || account < 0 {
+				log.Println("--index must be a non-negative number")
+				return
+			}
+		}
+		words, err := readSecret("Seed words: ", false)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		priv_key, err := keyFromSeed(words, uint32(account))
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		relays := opts["--relay"].([]string)
+		if len(relays) == 0 {
+			relays = srv.KnownRelays()
+		}
+		err = restoreEventStream(srv.store, srv.ots, name, priv_key, &Derivation{Path: seedPath(uint32(account))}, relays)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		fmt.Printf("\nRestored %s.\n", name)
+		return
+	case opts["forks"].(bool):
+		name := opts["<name>"].(string)
+		pubkey, err := srv.store.GetPubForName(name)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		es, err := srv.store.GetEventStream(pubkey)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		if as_json, _ := opts.Bool("--json"); as_json {
+			// Export the proofs so they can be verified elsewhere
+			proofs := es.Forks
+			if proofs == nil {
+				proofs = []ForkProof{}
+			}
+			out, _ := json.MarshalIndent(proofs, "", "  ")
+			fmt.Println(string(out))
+			return
+		}
+		if len(es.Forks) == 0 {
+			fmt.Printf("No forks found in %s.\n", name)
+			return
+		}
+		for _, proof := range es.Forks {
+			proof.Print()
+		}
+		return
+	case opts["verify-fork"].(bool):
+		proofs, err := readForkProofs(opts["<file>"].(string))
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		failed := false
+		for _, proof := range proofs {
+			if err := proof.Verify(); err != nil {
+				fmt.Printf("Invalid fork proof at %s: %s\n", showEventID(proof.Ancestor), err.Error())
+				failed = true
+				continue
+			}
+			fmt.Printf("Valid fork proof. %s signed both %s and %s on top of %s.\n",
+				showPubKey(proof.PubKey()), showEventID(proof.A.ID), showEventID(proof.B.ID), showEventID(proof.Ancestor))
+		}
+		if failed || len(proofs) == 0 {
+			os.Exit(1)
+		}
+		return
+	case opts["proof"].(bool):
+		id, _, err := parseEventID(opts["<id>"].(string))
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		es, err := srv.FindStreamOf(id)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		proof, err := es.InclusionProof(id)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		out, _ := json.MarshalIndent(proof, "", "  ")
+		fmt.Println(string(out))
+		return
+	case opts["verify-proof"].(bool):
+		proof, err := readInclusionProof(opts["<file>"].(string))
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		if err = proof.Verify(); err != nil {
+			fmt.Printf("Invalid inclusion proof: %s\n", err.Error())
+			os.Exit(1)
+		}
+		// Anyone can make a proof that agrees with itself, the root has to come from the
+		// command line or our copy of the stream
+		anchored := false
+		if root, _ := opts["--root"].(string); root != "" {
+			if root != proof.Root {
+				fmt.Printf("Invalid inclusion proof: it commits to root %s, not %s\n", proof.Root, root)
+				os.Exit(1)
+			}
+			anchored = true
+		}
+		if es, err := srv.store.GetEventStream(proof.PubKey); err == nil && es.Size() >= proof.MMRSize {
+			if local := buildMMR(es.Log[:proof.MMRSize]).Root(); local != proof.Root {
+				fmt.Printf("Invalid inclusion proof: our copy of %s has root %s at %d events\n", es.Name, local, proof.MMRSize)
+				os.Exit(1)
+			}
+			fmt.Printf("The root matches our copy of %s.\n", es.Name)
+			anchored = true
+		}
+		if !anchored {
+			fmt.Printf("Unanchored inclusion proof. Event %s is event %d under root %s, but we don't follow %s far enough to know the root is theirs. Pass the root with --root.\n",
+				showEventID(proof.EventID), proof.LeafIndex+1, proof.Root, showPubKey(proof.PubKey))
+			os.Exit(1)
+		}
+		fmt.Printf("Valid inclusion proof. Event %s is event %d of the stream of %s with root %s.\n",
+			showEventID(proof.EventID), proof.LeafIndex+1, showPubKey(proof.PubKey), proof.Root)
+		return
+	// es ots verify is handled with the active stream
+	case opts["verify"].(bool) && !opts["ots"].(bool):
+		var ess []*EventStream
+		// Verifying asks the header sources, the streams are only read
+		srv.Lock()
+		if all, _ := opts.Bool("--all"); all {
+			ess, err = srv.store.GetAllEventStreams()
+		} else {
+			var pubkey string
+			pubkey, err = srv.store.GetPubForName(opts["<name>"].(string))
+			if err == nil {
+				var es *EventStream
+				es, err = srv.store.GetEventStream(pubkey)
+				ess = []*EventStream{es}
+			}
+		}
+		srv.Unlock()
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		no_ots, _ := opts.Bool("--no-ots")
+		as_json, _ := opts.Bool("--json")
+		reports := []*VerifyReport{}
+		failed := false
+		for _, es := range ess {
+			report := es.Audit(srv.ots, !no_ots)
+			reports = append(reports, report)
+			failed = failed || !report.OK
+		}
+		if as_json {
+			var out []byte
+			if len(reports) == 1 && opts["<name>"] != nil {
+				out, _ = json.MarshalIndent(reports[0], "", "  ")
+			} else {
+				out, _ = json.MarshalIndent(reports, "", "  ")
+			}
+			fmt.Println(string(out))
+		} else {
+			for i, report := range reports {
+				if i > 0 {
+					fmt.Println()
+				}
+				report.Print()
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	case opts["headers"].(bool) && !opts["ots"].(bool):
+		chain, err := openHeaderChain(srv.config.DataDir, srv.config.GetNetwork())
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		switch {
+		case opts["import"].(bool):
+			num, err := chain.Import(opts["<file>"].(string))
+			if err != nil {
+				log.Println(err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("Imported %d headers.\n", num)
+		case opts["update"].(bool):
+			kind, location := "", ""
+			if opts["<source>"] != nil {
+				kind = opts["<source>"].(string)
+			}
+			if opts["<location>"] != nil {
+				location = opts["<location>"].(string)
+			}
+			src, err := srv.HeaderUpdateSource(kind, location)
+			if err != nil {
+				log.Println(err.Error())
+				os.Exit(1)
+			}
+			num, err := chain.Update(src)
+			if err != nil {
+				log.Println(err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("Added %d headers from %s.\n", num, src.Name())
+		}
+		if tip := chain.Tip(); tip != nil {
+			fmt.Printf("Local header chain at height %d: %s (%s)\n", chain.Height(), tip.BlockHash(), tip.Timestamp.UTC())
+		} else {
+			fmt.Println("The local header chain is empty. Import it with es headers import <file>.")
+		}
+		return
+	case opts["export"].(bool):
+		name := opts["<name>"].(string)
+		pubkey, err := srv.store.GetPubForName(name)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		es, err := srv.store.GetEventStream(pubkey)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		out := opts["--out"].(string)
+		err = es.Export(out)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Exported %d events of %s to %s.\n", es.Size(), name, out)
+		return
+	case opts["import"].(bool):
+		name := ""
+		if opts["--name"] != nil {
+			name = opts["--name"].(string)
+		}
+		es, err := importBundle(srv.store, srv.ots, opts["<file>"].(string), name)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %d events of %s (%s). HEAD at: %s\n", es.Size(), es.Name, showPubKey(es.PubKey), showEventID(es.GetHead()))
+		return
+	case opts["revoke"].(bool) || opts["rotate"].(bool):
+		name := opts["<name>"].(string)
+		pubkey, err := srv.store.GetPubForName(name)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		es, err := srv.store.GetEventStream(pubkey)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		reason := ""
+		if opts["--reason"] != nil {
+			reason = opts["--reason"].(string)
+		}
+		evs, err := srv.RevokeKey(es, reason, opts["rotate"].(bool))
+		// Keep what was appended even if a later step failed
+		srv.store.SaveEventStream(es)
+		if len(evs) > 0 {
+			nRevoke := NewNostr(es.ListRelays())
+			for _, ev := range evs {
+				if err := nRevoke.BroadcastEvent(es.ListRelays(), ev); err != nil {
+					log.Println(err.Error())
+				}
+			}
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		if es.IsRevoked() {
+			fmt.Printf("Revoked the key of %s. The stream is closed.\n", name)
+		} else {
+			fmt.Printf("Rotated the key of %s to %s.\n", name, showPubKey(es.SignerPubKey()))
+		}
+		return
+	// Calendars are set in the config, they don't need an active stream
+	case opts["ots"].(bool) && opts["calendar"].(bool):
+		switch {
+		case opts["add"].(bool):
+			err = srv.config.AddCalendar(opts["<url>"].(string))
+		case opts["remove"].(bool):
+			err = srv.config.RemoveCalendar(opts["<url>"].(string))
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		for _, url := range srv.config.Calendars {
+			fmt.Println("Url:", url)
+		}
+		fmt.Printf("Events need %d of the %d calendars to stamp them.\n", srv.config.CalendarQuorum, len(srv.config.Calendars))
+		return
+	case opts["ots"].(bool) && opts["info"].(bool):
+		id, _, err := parseEventID(opts["<id>"].(string))
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		ev, err := srv.store.FindEvent(id)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		info, err := inspectOTS(ev)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		fmt.Printf("Event: %s\n", showEventID(ev.ID))
+		info.Print()
+		return
+	case opts["ots"].(bool) && opts["watch"].(bool):
+		interval := DEFAULT_WATCH_INTERVAL
+		if val, _ := opts["--interval"]; val != nil {
+			interval, err = time.ParseDuration(val.(string))
+			if err != nil || interval <= 0 {
+				log.Println("--interval must be a positive duration, e.g. 5m")
+				return
+			}
+		}
+		err := watchOTS(srv, interval)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		return
+	case opts["ots"].(bool) && (opts["headers"].(bool) || opts["crosscheck"].(bool)):
+		if opts["<source>"] != nil {
+			location := ""
+			if opts["<location>"] != nil {
+				location = opts["<location>"].(string)
+			}
+			err := srv.config.SetHeaderSource(opts["<source>"].(string), location, opts["crosscheck"].(bool))
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+		}
+		fmt.Println("Block headers:", srv.config.GetHeaderSource())
+		if srv.config.CrossCheck != nil {
+			fmt.Println("Cross-checked with:", srv.config.CrossCheck)
+		} else {
+			fmt.Println("Cross-checked with: off")
+		}
+		return
+	case opts["ots"].(bool) && opts["quorum"].(bool):
+		quorum, err := opts.Int("<n>")
+		if err == nil {
+			err = srv.config.SetCalendarQuorum(quorum)
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		fmt.Printf("Events now need %d of the %d calendars to stamp them.\n", quorum, len(srv.config.Calendars))
+		return
+	case opts["ots"].(bool) && opts["slack"].(bool):
+		if opts["<duration>"] != nil {
+			slack, err := time.ParseDuration(opts["<duration>"].(string))
+			if err == nil {
+				err = srv.config.SetAttestationSlack(slack)
+			}
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+		}
+		fmt.Printf("Events can be created up to %s after the block that attests them.\n", srv.config.GetAttestationSlack())
+		return
+	case opts["fork-policy"].(bool):
+		policy := opts["<policy>"].(string)
+		err := srv.config.SetForkPolicy(policy)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		fmt.Printf("Forked streams now follow the %s policy.\n", policy)
+		return
+	case opts["display"].(bool):
+		format := opts["<format>"].(string)
+		err := srv.config.SetDisplay(format)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		fmt.Printf("Keys and event ids are now shown as %s.\n", format)
+		return
+	case opts["backend"].(bool):
+		backend := opts["<backend>"].(string)
+		err := srv.SwitchBackend(backend)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		fmt.Printf("Switched to the %s backend.\n", backend)
+		return
 	}
 
 	es_active, err := srv.store.GetActiveStream()
@@ -113,7 +771,15 @@ func main() {
 		require_active(srv.store)
 		pubkey := es_active.PubKey
 		if val, _ := opts["--name"]; val != nil {
-			pubkey, _ = srv.store.GetPubForName(val.(string))
+			// Streams can be given by their name or their pubkey
+			pubkey, err = srv.store.GetPubForName(val.(string))
+			if err != nil {
+				pubkey, _, err = parsePubKey(val.(string))
+			}
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
 		}
 		es, _ := srv.store.GetEventStream(pubkey)
 		es.Print(true)
@@ -121,12 +787,24 @@ func main() {
 		require_active(srv.store)
 		require_relays(es_active)
 		verbose, _ := opts.Bool("--verbose")
-		id := opts["<id>"].(string)
-		if id == "" {
+		if opts["<id>"].(string) == "" {
 			log.Println("provided event ID was empty")
 			return
 		}
-		ev, err := findEvent(n, id)
+		id, relays, err := parseEventID(opts["<id>"].(string))
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		// Ask the relays the event was published to as well
+		for _, url := range relays {
+			n.AddRelay(url)
+		}
+		// Look at the streams we store before asking the relays
+		ev, err := srv.store.FindEvent(id)
+		if err != nil {
+			ev, err = findEvent(n, id)
+		}
 		if err != nil {
 			fmt.Println(err.Error())
 			return
@@ -143,23 +821,39 @@ func main() {
 	case opts["append"].(bool):
 		require_active(srv.store)
 		require_relays(es_active)
-		content := opts["<content>"].(string)
-		ev, err := es_active.Create(content, srv.ots)
-		if err != nil {
+		// Several contents are appended in order and stamped together. Signing and stamping
+		// happen without the lock, the events are published once they're saved.
+		contents := opts["<content>"].([]string)
+		var evs []*nostr.Event
+		es, err := srv.UpdateStream(es_active.PubKey, func(es *EventStream) error {
+			var err error
+			evs, err = es.CreateBatch(contents, srv.SignerFor(es), srv.ots)
+			return err
+		})
+		if es == nil || (err != nil && len(evs) == 0) {
 			log.Panic(err.Error())
 		}
-		err = n.BroadcastEvent(es_active.Relays, *ev)
+		for _, ev := range evs {
+			if err := n.BroadcastEvent(es.Relays, *ev); err != nil {
+				log.Println(err.Error())
+				// Even if we failed to broadcast, the event is saved
+			}
+		}
+		for _, ev := range evs {
+			fmt.Println("Added event:", showEventID(ev.ID))
+		}
 		if err != nil {
-			log.Println(err.Error())
-			// Even if we failed to broadcast, we still save the event
+			log.Panic(err.Error())
 		}
-		srv.store.SaveEventStream(es_active)
-		fmt.Println("Added event:", ev.ID)
 	case opts["follow"].(bool):
 		require_active(srv.store)
-		pubkey := opts["<pubkey>"].(string)
+		pubkey, relays, err := parsePubKey(opts["<pubkey>"].(string))
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
 		name := opts["<name>"].(string)
-		err := srv.store.FollowEventStream(n, srv.ots, pubkey, name)
+		err = srv.Follow(n, pubkey, name, relays)
 		if err != nil {
 			log.Panic(err.Error())
 		} else {
@@ -178,9 +872,10 @@ func main() {
 			pubkey, _ := srv.store.GetPubForName(val.(string))
 			es, _ = srv.store.GetEventStream(pubkey)
 		}
-		err := es.Sync(n, srv.ots)
-		// We save first as we might have added a few new valid events before error
-		srv.store.SaveEventStream(es)
+		// Saves the events we added even if the sync fails halfway
+		_, err := srv.UpdateStream(es.PubKey, func(es *EventStream) error {
+			return es.Sync(n, srv.ots)
+		})
 		if err != nil {
 			log.Panic(err.Error())
 		}
@@ -217,16 +912,16 @@ func main() {
 				log.Println(err.Error())
 				return
 			}
-			es, err := srv.store.GetEventStream(pubkey)
+			num_upgraded, num_pending := 0, 0
+			_, err = srv.UpdateStream(pubkey, func(es *EventStream) error {
+				num_upgraded, num_pending = es.OTSUpgrade(srv.ots)
+				return nil
+			})
 			if err != nil {
 				log.Println(err.Error())
 				return
 			}
-			err = es.OTSUpgrade()
-			if err != nil {
-				log.Println(err.Error())
-			}
-			srv.store.SaveEventStream(es)
+			fmt.Printf("\nUpgraded %d attestations of %s from pending to complete, %d are still pending.\n", num_upgraded, name, num_pending)
 		case opts["verify"].(bool):
 			name := opts["<name>"].(string)
 			pubkey, err := srv.store.GetPubForName(name)
@@ -234,12 +929,37 @@ func main() {
 				log.Println(err.Error())
 				return
 			}
-			es, err := srv.store.GetEventStream(pubkey)
+			format := "text"
+			if opts["--format"] != nil {
+				format = opts["--format"].(string)
+			}
+			if format != "text" && format != "json" {
+				log.Printf("unknown format: %s", format)
+				return
+			}
+			// Verifying keeps the attestations it upgrades along the way
+			var report *OTSReport
+			_, err = srv.UpdateStream(pubkey, func(es *EventStream) error {
+				report = es.OTSVerify(srv.ots)
+				return nil
+			})
 			if err != nil {
 				log.Println(err.Error())
-				return
+				os.Exit(1)
+			}
+			if format == "json" {
+				out, err := json.MarshalIndent(report, "", "  ")
+				if err != nil {
+					log.Println(err.Error())
+					return
+				}
+				fmt.Println(string(out))
+			} else {
+				report.Print()
+			}
+			if !report.OK {
+				os.Exit(1)
 			}
-			es.OTSVerify(srv.ots)
 		case opts["rpc"].(bool):
 			host := opts["<url>"].(string)
 			user := opts["<user>"].(string)
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// A Merkle Mountain Range over the event ids of the main chain. It lets us prove an event is
+// part of a stream with a few hashes instead of the whole chain. Leaves are
+// H(0x00 || event id) and nodes are H(0x01 || left || right). The root bags the peaks from
+// right to left: H(0x01 || peak || H(0x01 || next peak || ...)).
+type MMR struct {
+	// Number of leaves
+	Size int `json:"size"`
+	// Roots of the perfect trees, the highest first
+	Peaks []string `json:"peaks"`
+}
+
+// Proof that an event is the leaf at the index of an MMR with the given number of leaves
+type InclusionProof struct {
+	PubKey string `json:"pubkey"`
+	// The successor key that signed the event after a key rotation
+	Signer    string       `json:"signer,omitempty"`
+	Event     *nostr.Event `json:"event,omitempty"`
+	EventID   string       `json:"event_id"`
+	LeafIndex int          `json:"leaf_index"`
+	MMRSize   int          `json:"mmr_size"`
+	// Hashes from the leaf up to its peak
+	Siblings []string `json:"siblings"`
+	Peaks    []string `json:"peaks"`
+	Root     string   `json:"root"`
+}
+
+func mmrLeaf(id string) ([]byte, error) {
+	id_bytes, err := hex.DecodeString(id)
+	if err != nil || len(id_bytes) != 32 {
+		return nil, fmt.Errorf("invalid event id %s", id)
+	}
+	h := sha256.Sum256(append([]byte{0x00}, id_bytes...))
+	return h[:], nil
+}
+
+func mmrNode(left []byte, right []byte) []byte {
+	data := append([]byte{0x01}, left...)
+	h := sha256.Sum256(append(data, right...))
+	return h[:]
+}
+
+func buildMMR(evs []nostr.Event) *MMR {
+	m := &MMR{Peaks: []string{}}
+	for _, ev := range evs {
+		m.Append(ev.ID)
+	}
+	return m
+}
+
+// Adds the event id as the next leaf. Only the peaks are kept, so this is O(log n).
+func (m *MMR) Append(id string) error {
+	h, err := mmrLeaf(id)
+	if err != nil {
+		return err
+	}
+	// Every trailing one bit of the size is a peak of the same height we merge with
+	for s := m.Size; s&1 == 1; s >>= 1 {
+		left, _ := hex.DecodeString(m.Peaks[len(m.Peaks)-1])
+		m.Peaks = m.Peaks[:len(m.Peaks)-1]
+		h = mmrNode(left, h)
+	}
+	m.Peaks = append(m.Peaks, hex.EncodeToString(h))
+	m.Size++
+
+	return nil
+}
+
+func (m *MMR) Root() string {
+	return bagPeaks(m.Peaks)
+}
+
+func bagPeaks(peaks []string) string {
+	if len(peaks) == 0 {
+		return ""
+	}
+	acc, _ := hex.DecodeString(peaks[len(peaks)-1])
+	for i := len(peaks) - 2; i >= 0; i-- {
+		peak, _ := hex.DecodeString(peaks[i])
+		acc = mmrNode(peak, acc)
+	}
+	return hex.EncodeToString(acc)
+}
+
+// Finds the mountain of the leaf. Returns the index of its peak, the index of its first leaf
+// and its height.
+func mountainOf(size int, leaf_index int) (int, int, int) {
+	start := 0
+	peak := 0
+	for height := bits.Len(uint(size)) - 1; height >= 0; height-- {
+		if size&(1<<height) == 0 {
+			continue
+		}
+		if leaf_index < start+(1<<height) {
+			return peak, start, height
+		}
+		start += 1 << height
+		peak++
+	}
+	return -1, 0, 0
+}
+
+// The MMR of the main chain, rebuilt if it doesn't match the chain
+func (es *EventStream) mmr() *MMR {
+	if es.unloaded != nil {
+		// The peaks saved with the stream, there are no events to rebuild them from
+		return es.MMR
+	}
+	if es.MMR == nil || es.MMR.Size != len(es.Log) {
+		es.MMR = buildMMR(es.Log)
+	}
+	return es.MMR
+}
+
+func (es *EventStream) MMRRoot() string {
+	return es.mmr().Root()
+}
+
+// Builds the inclusion proof of the event against the current MMR of the stream
+func (es *EventStream) InclusionProof(id string) (*InclusionProof, error) {
+	leaf_index := -1
+	for i, ev := range es.Log {
+		if ev.ID == id {
+			leaf_index = i
+		}
+	}
+	if leaf_index == -1 {
+		return nil, fmt.Errorf("event %s is not on the main chain of %s", id, es.Name)
+	}
+	m := es.mmr()
+	_, start, height := mountainOf(m.Size, leaf_index)
+
+	// Hash the mountain level by level and pick the sibling on the leaf's path
+	level := [][]byte{}
+	for _, ev := range es.Log[start : start+(1<<height)] {
+		h, err := mmrLeaf(ev.ID)
+		if err != nil {
+			return nil, err
+		}
+		level = append(level, h)
+	}
+	siblings := []string{}
+	pos := leaf_index - start
+	for len(level) > 1 {
+		siblings = append(siblings, hex.EncodeToString(level[pos^1]))
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, mmrNode(level[i], level[i+1]))
+		}
+		level = next
+		pos /= 2
+	}
+	ev := es.Log[leaf_index]
+	signer := ""
+	if ev.PubKey != es.PubKey {
+		signer = ev.PubKey
+	}
+
+	return &InclusionProof{
+		PubKey:    es.PubKey,
+		Signer:    signer,
+		Event:     &ev,
+		EventID:   id,
+		LeafIndex: leaf_index,
+		MMRSize:   m.Size,
+		Siblings:  siblings,
+		Peaks:     append([]string{}, m.Peaks...),
+		Root:      m.Root(),
+	}, nil
+}
+
+// Checks the proof is consistent and commits to its root. The event, if included, has to
+// match the event id and be signed by the stream's key or the successor the proof names. The
+// proof vouches for itself only, the root has to be checked against one we trust.
+func (p *InclusionProof) Verify() error {
+	if p.Event != nil {
+		if p.Event.ID != p.EventID || p.Event.GetID() != p.EventID {
+			return errors.New("event doesn't match the event id")
+		}
+		if ok, _ := p.Event.CheckSignature(); !ok {
+			return errors.New("invalid event signature")
+		}
+		signer := p.PubKey
+		if p.Signer != "" {
+			signer = p.Signer
+		}
+		if p.Event.PubKey != signer {
+			return fmt.Errorf("the event is signed by %s, not the stream's key %s", p.Event.PubKey, signer)
+		}
+	}
+	if p.LeafIndex < 0 || p.LeafIndex >= p.MMRSize {
+		return fmt.Errorf("leaf index %d is outside an MMR of %d leaves", p.LeafIndex, p.MMRSize)
+	}
+	peak, start, height := mountainOf(p.MMRSize, p.LeafIndex)
+	if len(p.Peaks) != bits.OnesCount(uint(p.MMRSize)) {
+		return errors.New("wrong number of peaks for the MMR size")
+	}
+	if len(p.Siblings) != height {
+		return errors.New("wrong number of siblings for the leaf")
+	}
+
+	h, err := mmrLeaf(p.EventID)
+	if err != nil {
+		return err
+	}
+	pos := p.LeafIndex - start
+	for _, sibling_hex := range p.Siblings {
+		sibling, err := hex.DecodeString(sibling_hex)
+		if err != nil || len(sibling) != 32 {
+			return fmt.Errorf("invalid sibling hash %s", sibling_hex)
+		}
+		if pos&1 == 0 {
+			h = mmrNode(h, sibling)
+		} else {
+			h = mmrNode(sibling, h)
+		}
+		pos /= 2
+	}
+	if hex.EncodeToString(h) != p.Peaks[peak] {
+		return errors.New("the event doesn't hash to its peak")
+	}
+	if bagPeaks(p.Peaks) != p.Root {
+		return errors.New("the peaks don't hash to the root")
+	}
+
+	return nil
+}
+
+func readInclusionProof(path string) (*InclusionProof, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var proof InclusionProof
+	if err = json.Unmarshal(data, &proof); err != nil {
+		return nil, fmt.Errorf("can't parse inclusion proof: %w", err)
+	}
+	return &proof, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// A main chain of n events, only the ids matter to the MMR
+func mmrStream(n int) *EventStream {
+	es := &EventStream{Name: "test", Log: []nostr.Event{}}
+	for i := 0; i < n; i++ {
+		id := sha256.Sum256([]byte(fmt.Sprintf("event %d", i)))
+		es.Log = append(es.Log, nostr.Event{ID: hex.EncodeToString(id[:])})
+	}
+	return es
+}
+
+func TestMMRRoot(t *testing.T) {
+	es := mmrStream(3)
+	leaf := func(i int) []byte {
+		h, _ := mmrLeaf(es.Log[i].ID)
+		return h
+	}
+	tests := []struct {
+		size int
+		root []byte
+	}{
+		{1, leaf(0)},
+		{2, mmrNode(leaf(0), leaf(1))},
+		// Two peaks bagged right to left
+		{3, mmrNode(mmrNode(leaf(0), leaf(1)), leaf(2))},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.size), func(t *testing.T) {
+			if root := buildMMR(es.Log[:tt.size]).Root(); root != hex.EncodeToString(tt.root) {
+				t.Fatalf("root is %s", root)
+			}
+		})
+	}
+}
+
+func TestMMRInclusionProofRoundTrip(t *testing.T) {
+	for size := 1; size <= 33; size++ {
+		es := mmrStream(size)
+		root := buildMMR(es.Log).Root()
+		for i := range es.Log {
+			proof, err := es.InclusionProof(es.Log[i].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The events aren't signed, the proof is about the id
+			proof.Event = nil
+			data, err := json.Marshal(proof)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded InclusionProof
+			if err = json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if err = decoded.Verify(); err != nil {
+				t.Fatalf("proof of leaf %d of %d: %v", i, size, err)
+			}
+			if decoded.Root != root {
+				t.Fatalf("proof of leaf %d of %d has root %s, want %s", i, size, decoded.Root, root)
+			}
+		}
+	}
+}
+
+func TestMMRInclusionProofRejects(t *testing.T) {
+	es := mmrStream(11)
+	other := mmrStream(12).Log[11].ID
+
+	tests := []struct {
+		name   string
+		tamper func(p *InclusionProof)
+	}{
+		{"another event", func(p *InclusionProof) { p.EventID = other }},
+		{"another leaf", func(p *InclusionProof) { p.LeafIndex++ }},
+		{"leaf past the size", func(p *InclusionProof) { p.LeafIndex = p.MMRSize }},
+		{"another size", func(p *InclusionProof) { p.MMRSize = 10 }},
+		{"changed sibling", func(p *InclusionProof) { p.Siblings[0] = p.Siblings[1] }},
+		{"missing sibling", func(p *InclusionProof) { p.Siblings = p.Siblings[1:] }},
+		{"changed peak", func(p *InclusionProof) { p.Peaks[0] = p.Peaks[1] }},
+		{"another root", func(p *InclusionProof) { p.Root = p.Peaks[0] }},
+		{"event that isn't the id", func(p *InclusionProof) { p.Event = &nostr.Event{ID: p.EventID} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof, err := es.InclusionProof(es.Log[5].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proof.Event = nil
+			tt.tamper(proof)
+			if err := proof.Verify(); err == nil {
+				t.Fatal("the tampered proof verified")
+			}
+		})
+	}
+}
+
+func TestMMRAppendMatchesRebuild(t *testing.T) {
+	es := mmrStream(20)
+	m := &MMR{Peaks: []string{}}
+	for i, ev := range es.Log {
+		if err := m.Append(ev.ID); err != nil {
+			t.Fatal(err)
+		}
+		if m.Root() != buildMMR(es.Log[:i+1]).Root() {
+			t.Fatalf("root after %d appends differs from the rebuilt one", i+1)
+		}
+	}
+	if err := m.Append("not an id"); err == nil {
+		t.Fatal("appended an invalid event id")
+	}
+}
+
+// The included event has to be signed by the stream's key, or the successor the proof names
+func TestMMRInclusionProofSigner(t *testing.T) {
+	ev := newTestEvent(t, "hello")
+	other := getPubKey(nostr.GeneratePrivateKey())
+
+	tests := []struct {
+		name   string
+		pubkey string
+		signer string
+		err    string
+	}{
+		{"stream key", ev.PubKey, "", ""},
+		{"successor key", other, ev.PubKey, ""},
+		{"another stream", other, "", "the event is signed by " + ev.PubKey},
+		{"another successor", ev.PubKey, other, "the event is signed by " + ev.PubKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es := &EventStream{Name: "test", PubKey: tt.pubkey, Log: []nostr.Event{*ev}}
+			proof, err := es.InclusionProof(ev.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.pubkey != ev.PubKey && proof.Signer != ev.PubKey {
+				t.Fatalf("the proof names signer %q", proof.Signer)
+			}
+			proof.PubKey = tt.pubkey
+			proof.Signer = tt.signer
+			err = proof.Verify()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+const (
+	NETWORK_MAINNET = "mainnet"
+	NETWORK_TESTNET = "testnet"
+	NETWORK_SIGNET  = "signet"
+	NETWORK_REGTEST = "regtest"
+)
+
+// A bitcoin network attestations can be verified on
+type BitcoinNetwork struct {
+	Name string
+	// What bitcoind calls the chain in getblockchaininfo
+	chain  string
+	params *chaincfg.Params
+	// Regtest keeps the difficulty of the genesis block forever
+	no_retargeting bool
+	// Defaults of a profile on the network. The public calendars only stamp on mainnet.
+	calendars []string
+	esplora   string
+}
+
+var networks = map[string]*BitcoinNetwork{
+	NETWORK_MAINNET: {
+		Name:      NETWORK_MAINNET,
+		chain:     "main",
+		params:    &chaincfg.MainNetParams,
+		calendars: DEFAULT_CALENDARS,
+		esplora:   DEFAULT_ESPLORA_URL,
+	},
+	NETWORK_TESTNET: {
+		Name:    NETWORK_TESTNET,
+		chain:   "test",
+		params:  &chaincfg.TestNet3Params,
+		esplora: "https://blockstream.info/testnet/api",
+	},
+	NETWORK_SIGNET: {
+		Name:    NETWORK_SIGNET,
+		chain:   "signet",
+		params:  &chaincfg.SigNetParams,
+		esplora: "https://mempool.space/signet/api",
+	},
+	NETWORK_REGTEST: {
+		Name:           NETWORK_REGTEST,
+		chain:          "regtest",
+		params:         &chaincfg.RegressionNetParams,
+		no_retargeting: true,
+	},
+}
+
+func getNetwork(name string) (*BitcoinNetwork, error) {
+	network, ok := networks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown bitcoin network %s, use one of mainnet, testnet, signet or regtest", name)
+	}
+	return network, nil
+}
+
+func (n *BitcoinNetwork) GenesisHash() string {
+	return n.params.GenesisHash.String()
+}
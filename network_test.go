@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckNetwork(t *testing.T) {
+	mainnet := newTestHeaders()
+	testnet := &testHeaders{blocks: map[uint64]*BlockHeader{
+		0: {Height: 0, Hash: networks[NETWORK_TESTNET].GenesisHash()},
+	}}
+
+	tests := []struct {
+		name        string
+		network     string
+		headers     *testHeaders
+		cross_check *testHeaders
+		err         string
+	}{
+		{"mainnet", NETWORK_MAINNET, mainnet, nil, ""},
+		{"testnet", NETWORK_TESTNET, testnet, nil, ""},
+		{"mainnet headers on testnet", NETWORK_TESTNET, mainnet, nil, "test headers is not on testnet"},
+		{"testnet headers on regtest", NETWORK_REGTEST, testnet, nil, "is not on regtest"},
+		{"cross-check on another network", NETWORK_MAINNET, mainnet, testnet, "is not on mainnet"},
+		{"no genesis block", NETWORK_MAINNET, &testHeaders{blocks: map[uint64]*BlockHeader{}}, nil, "can't get the genesis block"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ots := newTestOTS(tt.headers, 1)
+			ots.network = networks[tt.network]
+			if tt.cross_check != nil {
+				ots.cross_check = tt.cross_check
+			}
+			err := ots.checkNetwork()
+			if tt.err == "" {
+				if err != nil || !ots.network_checked {
+					t.Fatalf("got error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) || ots.network_checked {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// Every network has its own header chain file in the data directory
+func TestHeaderChainFilePerNetwork(t *testing.T) {
+	dir := t.TempDir()
+	paths := map[string]string{}
+	for name, network := range networks {
+		c, err := openHeaderChain(dir, network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(c.path) != dir {
+			t.Fatalf("%s header chain is at %s", name, c.path)
+		}
+		if other, ok := paths[c.path]; ok {
+			t.Fatalf("%s and %s share the header chain %s", name, other, c.path)
+		}
+		paths[c.path] = name
+	}
+	if c, _ := openHeaderChain(dir, networks[NETWORK_MAINNET]); filepath.Base(c.path) != HEADER_CHAIN_FILE {
+		t.Fatalf("the mainnet header chain moved to %s", c.path)
+	}
+}
+
+func TestDefaultHeaderSource(t *testing.T) {
+	tests := []struct {
+		network string
+		kind    string
+		err     string
+	}{
+		{NETWORK_MAINNET, HEADERS_BLOCKCHAIN_INFO, ""},
+		{NETWORK_TESTNET, HEADERS_ESPLORA, ""},
+		{NETWORK_SIGNET, HEADERS_ESPLORA, ""},
+		{NETWORK_REGTEST, HEADERS_RPC, "no bitcoin rpc configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			cfg := &Config{Profile: Profile{Network: tt.network}}
+			sc := cfg.GetHeaderSource()
+			if sc.Kind != tt.kind {
+				t.Fatalf("default header source is %s", sc)
+			}
+			_, err := newHeaderSource(cfg, sc)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	// blockchain.info only knows mainnet
+	cfg := &Config{Profile: Profile{Network: NETWORK_TESTNET}}
+	if _, err := newHeaderSource(cfg, &HeaderSourceConfig{Kind: HEADERS_BLOCKCHAIN_INFO}); err == nil {
+		t.Fatal("blockchain.info is a header source on testnet")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Formats keys and event ids are printed in
+const (
+	DISPLAY_HEX    = "hex"
+	DISPLAY_BECH32 = "bech32"
+)
+
+// Set from the config when the service loads
+var displayFormat = DISPLAY_HEX
+
+// Parses a pubkey given as hex, npub or nprofile. Relay hints of an nprofile are returned
+// along with the key.
+func parsePubKey(input string) (string, []string, error) {
+	if isHexKey(input) {
+		return strings.ToLower(input), nil, nil
+	}
+	prefix, value, err := nip19.Decode(input)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid pubkey %s: %w", input, err)
+	}
+	switch prefix {
+	case "npub":
+		return value.(string), nil, nil
+	case "nprofile":
+		profile := value.(nip19.ProfilePointer)
+		return profile.PublicKey, profile.Relays, nil
+	}
+
+	return "", nil, fmt.Errorf("expected a hex pubkey, npub or nprofile, got %s", prefix)
+}
+
+// Parses an event id given as hex, note or nevent. Relay hints of an nevent are returned
+// along with the id.
+func parseEventID(input string) (string, []string, error) {
+	if isHexKey(input) {
+		return strings.ToLower(input), nil, nil
+	}
+	prefix, value, err := nip19.Decode(input)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid event id %s: %w", input, err)
+	}
+	switch prefix {
+	case "note":
+		return value.(string), nil, nil
+	case "nevent":
+		pointer := value.(nip19.EventPointer)
+		return pointer.ID, pointer.Relays, nil
+	}
+
+	return "", nil, fmt.Errorf("expected a hex event id, note or nevent, got %s", prefix)
+}
+
+// Parses a private key given as hex or nsec
+func parsePrivKey(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if isHexKey(input) {
+		return strings.ToLower(input), nil
+	}
+	prefix, value, err := nip19.Decode(input)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %w", err)
+	}
+	if prefix != "nsec" {
+		return "", fmt.Errorf("expected a hex private key or nsec, got %s", prefix)
+	}
+
+	return value.(string), nil
+}
+
+func isHexKey(input string) bool {
+	b, err := hex.DecodeString(input)
+	return err == nil && len(b) == 32
+}
+
+// Renders a pubkey in the display format
+func showPubKey(pubkey string) string {
+	if displayFormat == DISPLAY_BECH32 {
+		if npub, err := nip19.EncodePublicKey(pubkey); err == nil {
+			return npub
+		}
+	}
+	return pubkey
+}
+
+// Renders an event id in the display format
+func showEventID(id string) string {
+	if displayFormat == DISPLAY_BECH32 {
+		if note, err := nip19.EncodeNote(id); err == nil {
+			return note
+		}
+	}
+	return id
+}
+
+// Shortens a key or id rendered by showPubKey or showEventID. The bech32 prefix is kept so
+// we can tell an npub from a note.
+func shortenShown(s string) string {
+	if i := strings.Index(s, "1"); displayFormat == DISPLAY_BECH32 && i > 0 && len(s) > i+9 {
+		return s[0:i+5] + "..." + s[len(s)-4:]
+	}
+	return shorten(s)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Vectors from NIP-19
+const (
+	nip19Npub      = "npub10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qzvjptg"
+	nip19PubKey    = "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+	nip19Nsec      = "nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5"
+	nip19PrivKey   = "67dea2ed018072d675f5415ecfaed7d2597555e202d85b3d65ea4e58d2d92ffa"
+	nip19Nprofile  = "nprofile1qqsrhuxx8l9ex335q7he0f09aej04zpazpl0ne2cgukyawd24mayt8gpp4mhxue69uhhytnc9e3k7mgpz4mhxue69uhkg6nzv9ejuumpv34kytnrdaksjlyr9p"
+	nip19ProfilePK = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+)
+
+func TestParsePubKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   string
+		relays []string
+		err    string
+	}{
+		{"hex", nip19PubKey, nip19PubKey, nil, ""},
+		{"upper case hex", strings.ToUpper(nip19PubKey), nip19PubKey, nil, ""},
+		{"npub", nip19Npub, nip19PubKey, nil, ""},
+		{"nprofile", nip19Nprofile, nip19ProfilePK, []string{"wss://r.x.com", "wss://djbas.sadkb.com"}, ""},
+		{"nsec", nip19Nsec, "", nil, "expected a hex pubkey, npub or nprofile"},
+		{"bad checksum", nip19Npub[:len(nip19Npub)-1] + "q", "", nil, "invalid pubkey"},
+		{"short hex", nip19PubKey[:62], "", nil, "invalid pubkey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, relays, err := parsePubKey(tt.input)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || !reflect.DeepEqual(relays, tt.relays) {
+				t.Fatalf("got %s %v", got, relays)
+			}
+		})
+	}
+}
+
+func TestParseEventID(t *testing.T) {
+	id := nip19PubKey
+	note, _ := nip19.EncodeNote(id)
+	nevent, _ := nip19.EncodeEvent(id, []string{"wss://relay.example"})
+	npub, _ := nip19.EncodePublicKey(id)
+
+	tests := []struct {
+		name   string
+		input  string
+		relays []string
+		err    string
+	}{
+		{"hex", id, nil, ""},
+		{"note", note, nil, ""},
+		{"nevent", nevent, []string{"wss://relay.example"}, ""},
+		{"npub", npub, nil, "expected a hex event id, note or nevent"},
+		{"garbage", "note1garbage", nil, "invalid event id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, relays, err := parseEventID(tt.input)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != id || !reflect.DeepEqual(relays, tt.relays) {
+				t.Fatalf("got %s %v", got, relays)
+			}
+		})
+	}
+}
+
+func TestParsePrivKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		err   string
+	}{
+		{"hex", nip19PrivKey, nip19PrivKey, ""},
+		{"nsec", nip19Nsec, nip19PrivKey, ""},
+		{"nsec with whitespace", " " + nip19Nsec + "\n", nip19PrivKey, ""},
+		{"npub", nip19Npub, "", "expected a hex private key or nsec"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePrivKey(tt.input)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %s: %v", got, err)
+			}
+		})
+	}
+}
+
+func TestShowInDisplayFormat(t *testing.T) {
+	defer func(format string) { displayFormat = format }(displayFormat)
+
+	tests := []struct {
+		format string
+		pubkey string
+		id     string
+	}{
+		{DISPLAY_HEX, nip19PubKey, nip19PubKey},
+		{DISPLAY_BECH32, nip19Npub, "note10elfcs4fr0l0r8af98jlmgdh9c8tcxjvz9qkw038js35mp4dma8qnx3ujq"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			displayFormat = tt.format
+			if got := showPubKey(nip19PubKey); got != tt.pubkey {
+				t.Fatalf("pubkey shown as %s", got)
+			}
+			if got := showEventID(nip19PubKey); got != tt.id {
+				t.Fatalf("event id shown as %s", got)
+			}
+			// What we show parses back
+			if pubkey, _, err := parsePubKey(showPubKey(nip19PubKey)); err != nil || pubkey != nip19PubKey {
+				t.Fatalf("shown pubkey parsed to %s: %v", pubkey, err)
+			}
+			if id, _, err := parseEventID(showEventID(nip19PubKey)); err != nil || id != nip19PubKey {
+				t.Fatalf("shown event id parsed to %s: %v", id, err)
+			}
+		})
+	}
+}
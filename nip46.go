@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// NIP-46 (Nostr Connect) lets a stream be signed by a remote signer, a "bunker", that holds
+// the private key. Requests and responses are nip04 encrypted events of this kind.
+const KindNostrConnect = 24133
+
+const remoteSignerTimeout = time.Minute
+
+// How to reach the remote signer of a stream. Parsed from a bunker url
+// bunker://<remote pubkey>?relay=<url>&secret=<secret>
+type RemoteSignerConfig struct {
+	RemotePubKey string   `json:"remote_pubkey"`
+	Relays       []string `json:"relays"`
+	Secret       string   `json:"secret,omitempty"`
+	// Key we use to talk to the bunker. It identifies us, not the stream.
+	ClientKey string `json:"client_key"`
+}
+
+type nip46Request struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+type nip46Response struct {
+	ID     string `json:"id"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func parseBunkerURL(bunker_url string) (*RemoteSignerConfig, error) {
+	u, err := url.Parse(bunker_url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "bunker" {
+		return nil, fmt.Errorf("expected a bunker:// url, got %s", bunker_url)
+	}
+	remote_pubkey, _, err := parsePubKey(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &RemoteSignerConfig{
+		RemotePubKey: remote_pubkey,
+		Relays:       u.Query()["relay"],
+		Secret:       u.Query().Get("secret"),
+		ClientKey:    nostr.GeneratePrivateKey(),
+	}
+	if len(cfg.Relays) == 0 {
+		return nil, errors.New("the bunker url has no relay")
+	}
+
+	return cfg, nil
+}
+
+func bunkerURL(pubkey string, relays []string, secret string) string {
+	q := url.Values{}
+	for _, relay := range relays {
+		q.Add("relay", relay)
+	}
+	if secret != "" {
+		q.Set("secret", secret)
+	}
+	return fmt.Sprintf("bunker://%s?%s", pubkey, q.Encode())
+}
+
+// Signs events by sending them to a remote signer over nostr relays
+type RemoteSigner struct {
+	cfg *RemoteSignerConfig
+}
+
+func (s *RemoteSigner) Sign(ev *nostr.Event) error {
+	n := NewNostr(s.cfg.Relays)
+	if len(n.Pool) == 0 {
+		return errors.New("can't connect to any of the remote signer relays")
+	}
+	client_pubkey := getPubKey(s.cfg.ClientKey)
+	shared, err := nip04.ComputeSharedSecret(s.cfg.ClientKey, s.cfg.RemotePubKey)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteSignerTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	evt_chan := make(chan nostr.Event)
+	since := time.Now().Add(-time.Minute)
+	n.Listen(&wg, ctx, evt_chan, nostr.Filter{
+		Kinds:   []int{KindNostrConnect},
+		Authors: []string{s.cfg.RemotePubKey},
+		Tags:    nostr.TagMap{"p": []string{client_pubkey}},
+		Since:   &since,
+	})
+	defer func() {
+		cancel()
+		// Drain the subscriptions so they can shut down
+		go func() {
+			for range evt_chan {
+			}
+		}()
+		wg.Wait()
+	}()
+
+	// Identify ourselves with the secret, the bunker may not know us yet
+	_, err = s.call(ctx, n, shared, evt_chan, "connect", []string{s.cfg.RemotePubKey, s.cfg.Secret})
+	if err != nil {
+		return fmt.Errorf("remote signer refused to connect: %w", err)
+	}
+	unsigned, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	result, err := s.call(ctx, n, shared, evt_chan, "sign_event", []string{string(unsigned)})
+	if err != nil {
+		return err
+	}
+	var signed nostr.Event
+	if err = json.Unmarshal([]byte(result), &signed); err != nil {
+		return fmt.Errorf("remote signer returned an invalid event: %w", err)
+	}
+	if signed.ID != ev.GetID() {
+		return errors.New("remote signer signed a different event")
+	}
+	if ok, _ := signed.CheckSignature(); !ok {
+		return errors.New("remote signer returned an invalid signature")
+	}
+	ev.ID = signed.ID
+	ev.Sig = signed.Sig
+
+	return nil
+}
+
+// Sends a request to the remote signer and waits for its response
+func (s *RemoteSigner) call(ctx context.Context, n *Nostr, shared []byte, evt_chan chan nostr.Event, method string, params []string) (string, error) {
+	req := nip46Request{ID: randomHex(8), Method: method, Params: params}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	ev, err := nip46Event(s.cfg.ClientKey, s.cfg.RemotePubKey, shared, payload)
+	if err != nil {
+		return "", err
+	}
+	// The request reaches the bunker as long as one relay accepts it
+	n.BroadcastEvent(s.cfg.Relays, *ev)
+
+	for {
+		select {
+		case resp_ev := <-evt_chan:
+			plain, err := nip04.Decrypt(resp_ev.Content, shared)
+			if err != nil {
+				continue
+			}
+			var resp nip46Response
+			if json.Unmarshal([]byte(plain), &resp) != nil || resp.ID != req.ID {
+				continue
+			}
+			if resp.Error != "" {
+				return "", errors.New(resp.Error)
+			}
+			return resp.Result, nil
+		case <-ctx.Done():
+			return "", fmt.Errorf("no response from the remote signer to %s", method)
+		}
+	}
+}
+
+// Builds a signed, encrypted NIP-46 message
+func nip46Event(priv_key string, to_pubkey string, shared []byte, payload []byte) (*nostr.Event, error) {
+	content, err := nip04.Encrypt(string(payload), shared)
+	if err != nil {
+		return nil, err
+	}
+	ev := &nostr.Event{
+		PubKey:    getPubKey(priv_key),
+		CreatedAt: time.Now(),
+		Kind:      KindNostrConnect,
+		Tags:      nostr.Tags{nostr.Tag{"p", to_pubkey}},
+		Content:   content,
+	}
+	if err = ev.Sign(priv_key); err != nil {
+		return nil, err
+	}
+
+	return ev, nil
+}
+
+// Runs a remote signer for the stream on the given relays until it gets interrupted. Clients
+// have to present the stream's bunker secret once, after that they are allowed to sign for the
+// session.
+func runBunker(es *EventStream, relays []string) error {
+	priv_key, err := es.UnlockPrivKey()
+	if err != nil {
+		return err
+	}
+	n := NewNostr(relays)
+	if len(n.Pool) == 0 {
+		return errors.New("can't connect to any of the relays")
+	}
+	secret := es.BunkerSecret
+	if secret == "" {
+		return errors.New("the stream has no bunker secret")
+	}
+	fmt.Printf("Remote signer for %s is running. Connect to it with\n\n", es.Name)
+	// After a key rotation the bunker signs with the successor key
+	pubkey := es.SignerPubKey()
+	fmt.Printf("es signer connect <name> '%s'\n", bunkerURL(pubkey, relays, secret))
+
+	cancel_chan := make(chan os.Signal, 1)
+	signal.Notify(cancel_chan, syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	evt_chan := make(chan nostr.Event)
+	since := time.Now()
+	n.Listen(&wg, ctx, evt_chan, nostr.Filter{
+		Kinds: []int{KindNostrConnect},
+		Tags:  nostr.TagMap{"p": []string{pubkey}},
+		Since: &since,
+	})
+
+	authorized := map[string]bool{}
+	seen := map[string]bool{}
+L:
+	for {
+		select {
+		case ev := <-evt_chan:
+			// Every relay sends us the same request
+			if seen[ev.ID] {
+				continue
+			}
+			seen[ev.ID] = true
+			resp_ev, err := handleBunkerRequest(priv_key, pubkey, secret, authorized, ev)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			n.BroadcastEvent(relays, *resp_ev)
+		case <-cancel_chan:
+			cancel()
+			break L
+		}
+	}
+	go func() {
+		for range evt_chan {
+		}
+	}()
+	wg.Wait()
+	fmt.Println("\nRemote signer stopped.")
+
+	return nil
+}
+
+func handleBunkerRequest(priv_key string, pubkey string, secret string, authorized map[string]bool, ev nostr.Event) (*nostr.Event, error) {
+	if ok, _ := ev.CheckSignature(); !ok {
+		return nil, fmt.Errorf("ignoring request %s with an invalid signature", ev.ID)
+	}
+	shared, err := nip04.ComputeSharedSecret(priv_key, ev.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := nip04.Decrypt(ev.Content, shared)
+	if err != nil {
+		return nil, err
+	}
+	var req nip46Request
+	if err = json.Unmarshal([]byte(plain), &req); err != nil {
+		return nil, err
+	}
+
+	resp := nip46Response{ID: req.ID}
+	switch {
+	case req.Method == "connect":
+		if authorized[ev.PubKey] || (len(req.Params) > 1 && req.Params[1] == secret) {
+			authorized[ev.PubKey] = true
+			resp.Result = "ack"
+			fmt.Printf("\nClient %s connected.", ev.PubKey)
+		} else {
+			resp.Error = "invalid secret"
+		}
+	case !authorized[ev.PubKey]:
+		resp.Error = "unauthorized, connect first"
+	case req.Method == "get_public_key":
+		resp.Result = pubkey
+	case req.Method == "ping":
+		resp.Result = "pong"
+	case req.Method == "sign_event" && len(req.Params) == 1:
+		var unsigned nostr.Event
+		if err = json.Unmarshal([]byte(req.Params[0]), &unsigned); err != nil {
+			resp.Error = "invalid event"
+			break
+		}
+		if unsigned.PubKey != pubkey {
+			resp.Error = "can only sign events of " + pubkey
+			break
+		}
+		if err = unsigned.Sign(priv_key); err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		signed, _ := json.Marshal(unsigned)
+		resp.Result = string(signed)
+		fmt.Printf("\nSigned event %s for client %s.", unsigned.ID, ev.PubKey)
+	default:
+		resp.Error = "unsupported method: " + req.Method
+	}
+
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return nip46Event(priv_key, ev.PubKey, shared, payload)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
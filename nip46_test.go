@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+func TestBunkerURLRoundTrip(t *testing.T) {
+	relays := []string{"wss://a.example", "wss://b.example"}
+	cfg, err := parseBunkerURL(bunkerURL(nip19PubKey, relays, "s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RemotePubKey != nip19PubKey || !reflect.DeepEqual(cfg.Relays, relays) || cfg.Secret != "s3cret" {
+		t.Fatalf("parsed to %+v", cfg)
+	}
+	if cfg.ClientKey == "" {
+		t.Fatal("no client key")
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		err  string
+	}{
+		{"npub", "bunker://" + nip19Npub + "?relay=wss://a.example", ""},
+		{"wrong scheme", "nostrconnect://" + nip19PubKey + "?relay=wss://a.example", "expected a bunker:// url"},
+		{"no relay", "bunker://" + nip19PubKey, "the bunker url has no relay"},
+		{"bad pubkey", "bunker://abcd?relay=wss://a.example", "invalid pubkey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseBunkerURL(tt.url)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// A client talking to the bunker, requests run in order against the same session
+func TestHandleBunkerRequest(t *testing.T) {
+	bunker_key := nostr.GeneratePrivateKey()
+	bunker_pubkey := getPubKey(bunker_key)
+	client_key := nostr.GeneratePrivateKey()
+	shared, err := nip04.ComputeSharedSecret(client_key, bunker_pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := func(pubkey string) string {
+		ev := nostr.Event{PubKey: pubkey, CreatedAt: time.Now(), Kind: nostr.KindTextNote, Tags: nostr.Tags{}, Content: "hello"}
+		data, _ := json.Marshal(ev)
+		return string(data)
+	}
+	authorized := map[string]bool{}
+
+	tests := []struct {
+		name   string
+		method string
+		params []string
+		result string
+		err    string
+	}{
+		{"ping before connect", "ping", nil, "", "unauthorized, connect first"},
+		{"wrong secret", "connect", []string{bunker_pubkey, "guess"}, "", "invalid secret"},
+		{"no secret", "connect", []string{bunker_pubkey}, "", "invalid secret"},
+		{"connect", "connect", []string{bunker_pubkey, "s3cret"}, "ack", ""},
+		{"connect again", "connect", []string{bunker_pubkey}, "ack", ""},
+		{"ping", "ping", nil, "pong", ""},
+		{"get_public_key", "get_public_key", nil, bunker_pubkey, ""},
+		{"sign_event", "sign_event", []string{unsigned(bunker_pubkey)}, "", ""},
+		{"sign_event of another key", "sign_event", []string{unsigned(getPubKey(client_key))}, "", "can only sign events of " + bunker_pubkey},
+		{"invalid event", "sign_event", []string{"{"}, "", "invalid event"},
+		{"unsupported", "nip04_encrypt", []string{"x"}, "", "unsupported method: nip04_encrypt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, _ := json.Marshal(nip46Request{ID: randomHex(8), Method: tt.method, Params: tt.params})
+			req, err := nip46Event(client_key, bunker_pubkey, shared, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp_ev, err := handleBunkerRequest(bunker_key, bunker_pubkey, "s3cret", authorized, *req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp_ev.PubKey != bunker_pubkey || resp_ev.Kind != KindNostrConnect || resp_ev.Tags.GetFirst([]string{"p", getPubKey(client_key)}) == nil {
+				t.Fatalf("response event %+v", resp_ev)
+			}
+			if ok, _ := resp_ev.CheckSignature(); !ok {
+				t.Fatal("the response isn't signed")
+			}
+			plain, err := nip04.Decrypt(resp_ev.Content, shared)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp nip46Response
+			if err = json.Unmarshal([]byte(plain), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var sent nip46Request
+			json.Unmarshal(payload, &sent)
+			if resp.ID != sent.ID || resp.Error != tt.err {
+				t.Fatalf("got response %+v", resp)
+			}
+			if tt.method != "sign_event" {
+				if resp.Result != tt.result {
+					t.Fatalf("got result %q, want %q", resp.Result, tt.result)
+				}
+				return
+			}
+			if tt.err != "" {
+				return
+			}
+			var signed nostr.Event
+			if err = json.Unmarshal([]byte(resp.Result), &signed); err != nil {
+				t.Fatal(err)
+			}
+			if ok, _ := signed.CheckSignature(); !ok || signed.PubKey != bunker_pubkey {
+				t.Fatalf("signed event %+v", signed)
+			}
+		})
+	}
+}
+
+func TestHandleBunkerRequestRejectsForgedRequest(t *testing.T) {
+	bunker_key := nostr.GeneratePrivateKey()
+	bunker_pubkey := getPubKey(bunker_key)
+	client_key := nostr.GeneratePrivateKey()
+	shared, _ := nip04.ComputeSharedSecret(client_key, bunker_pubkey)
+	payload, _ := json.Marshal(nip46Request{ID: "1", Method: "connect", Params: []string{bunker_pubkey, "s3cret"}})
+	req, err := nip46Event(client_key, bunker_pubkey, shared, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claims to come from someone else
+	req.PubKey = getPubKey(nostr.GeneratePrivateKey())
+	authorized := map[string]bool{}
+	if _, err = handleBunkerRequest(bunker_key, bunker_pubkey, "s3cret", authorized, *req); err == nil {
+		t.Fatal("handled a request with an invalid signature")
+	}
+	if len(authorized) != 0 {
+		t.Fatal("a forged request got authorized")
+	}
+}
@@ -66,21 +66,22 @@ func (n *Nostr) SingleQueryPool(filter nostr.Filter) ([]nostr.Event, error) {
 	if len(n.Pool) == 0 {
 		return []nostr.Event{}, errors.New("relay pool is empty")
 	}
-	evsAggregator := make(chan []nostr.Event)
+	evsAggregator := make(chan []nostr.Event, len(n.Pool))
 	var wg sync.WaitGroup
 
 	// TODO: Figure out what to do if the pool has too many relays
-	for relayUrl, _ := range n.Pool {
+	for relayUrl := range n.Pool {
 		wg.Add(1)
-		go func() {
+		go func(relayUrl string) {
 			defer wg.Done()
 			evs, err := n.SingleQuery(relayUrl, filter)
 			if err == nil && len(evs) > 0 {
 				evsAggregator <- evs
 			}
-		}()
+		}(relayUrl)
 	}
 	wg.Wait()
+	close(evsAggregator)
 
 	// We probably got a lot of the same events from different relays. Make a unique list
 	seen := map[string]bool{}
@@ -128,7 +129,7 @@ func (n *Nostr) BroadcastEvent(relayUrls []string, ev nostr.Event) error {
 	for _, relayUrl := range relayUrls {
 		status, err := n.SendEvent(relayUrl, ev)
 		if err != nil {
-			log.Printf("Error: event: %s to relay %s. Error: %w", ev.ID, relayUrl, err)
+			log.Printf("Error: event: %s to relay %s. Error: %v", ev.ID, relayUrl, err)
 			gotErr = true
 		}
 		if status != 1 {
@@ -2,16 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	b64 "encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/btcsuite/btcd/rpcclient"
@@ -25,200 +27,452 @@ var (
 	ErrOTSWaitingConfirmations = errors.New("waiting for 5 confirmations")
 )
 
-const defaultCalendar = "https://alice.btc.calendar.opentimestamps.org"
-
-// The response of blockchain.info request
-type BlockchainInfoResp struct {
-	Blocks []BlocksResp `json:"blocks"`
-}
-type BlocksResp struct {
-	MerkleRoot string `json:"mrkl_root"`
-	Timestamp  int    `json:"time"`
-}
+var calendarClient = &http.Client{Timeout: 30 * time.Second}
 
 type OTSService struct {
-	rpcclient *BTCRPCClient
+	// Blocks we verify attestations against and an optional second source that has to agree
+	headers     BlockHeaderSource
+	cross_check BlockHeaderSource
+	calendars   []string
+	// How many calendars have to stamp an event
+	quorum int
+	// Calendar answers by calendar and commitment. Events stamped in a batch share the
+	// commitment, so upgrading them asks the calendar once.
+	upgrades map[string][]byte
+	// Block headers we already got, checking the attestation order asks for the same blocks again
+	blocks map[uint64]*BlockHeader
+	slack  time.Duration
+	// The chain attestations are verified on, the header sources have to be on it too
+	network         *BitcoinNetwork
+	network_checked bool
 }
 
 // OpenTimestamps an event and return the stamp data
 func (o *OTSService) Stamp(ev *nostr.Event) (string, error) {
-	cal, err := opentimestamps.NewRemoteCalendar(defaultCalendar)
+	digest_32 := sha256.Sum256(ev.Serialize())
+	root, err := o.stampDigest(digest_32[:], "event "+ev.ID)
 	if err != nil {
-		return "", fmt.Errorf("error creating remote calendar: %v", err)
+		return "", err
 	}
-	digest_32 := sha256.Sum256(ev.Serialize())
-	digest := digest_32[:]
-	// base_path, _ := homedir.Expand(CONFIG_BASE_DIR)
-	// // We will save the .ots in <event_id>.ots
-	// path := filepath.Join(base_path, ev.ID)
-	// outFile, err := os.Create(path + ".ots")
-	// if err != nil {
-	// 	return "", fmt.Errorf("error creating output file: %v", err)
-	// }
-
-	// Create a timestamp
-	dts, err := opentimestamps.CreateDetachedTimestampForHash(digest, cal)
-	if err != nil {
-		return "", fmt.Errorf("error creating detached timestamp: %v", err)
-	}
-	// if err := dts.WriteToStream(outFile); err != nil {
-	// 	return "", fmt.Errorf("error writing detached timestamp: %v", err)
-	// }
-	buf := new(bytes.Buffer)
-	if err := dts.WriteToStream(buf); err != nil {
-		return "", fmt.Errorf("error writing detached timestamp to buf: %v", err)
+	return encodeOTS(&OTSFile{HashOp: OTS_OP_SHA256, Timestamp: root}), nil
+}
+
+// Stamps several events with a single calendar round trip. The events are the leaves of a
+// merkle tree and only its root is submitted. The stamp of every event holds its path to the
+// root followed by what the calendars returned, so each one verifies on its own.
+func (o *OTSService) StampBatch(evs []*nostr.Event) ([]string, error) {
+	if len(evs) == 1 {
+		stamp, err := o.Stamp(evs[0])
+		return []string{stamp}, err
+	}
+	leaves := make([]*OTSTimestamp, len(evs))
+	for i, ev := range evs {
+		digest := sha256.Sum256(ev.Serialize())
+		leaves[i] = &OTSTimestamp{Msg: digest[:]}
+	}
+	tip, err := buildMerkleTree(leaves)
+	if err != nil {
+		return nil, err
+	}
+	root, err := o.stampDigest(tip.Msg, fmt.Sprintf("the batch of %d events", len(evs)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tip.Merge(root); err != nil {
+		return nil, err
 	}
 
-	ots_content := buf.String()
-	ots_b64 := b64.StdEncoding.EncodeToString([]byte(ots_content))
-	return ots_b64, nil
+	stamps := make([]string, len(evs))
+	for i, leaf := range leaves {
+		stamps[i] = encodeOTS(&OTSFile{HashOp: OTS_OP_SHA256, Timestamp: leaf})
+	}
+	return stamps, nil
 }
 
-// Poor man's implementation of a check if ots has been upgraded
+// Builds a merkle tree over the leaves the way the ots client does and returns its tip. Every
+// leaf is first hashed with a random nonce so the tree doesn't reveal the other digests.
+func buildMerkleTree(leaves []*OTSTimestamp) (*OTSTimestamp, error) {
+	level := []*OTSTimestamp{}
+	for _, leaf := range leaves {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		salted, err := leaf.addOp(OTSOp{Code: OTS_OP_APPEND, Arg: nonce})
+		if err != nil {
+			return nil, err
+		}
+		hashed, err := salted.addOp(OTSOp{Code: OTS_OP_SHA256})
+		if err != nil {
+			return nil, err
+		}
+		level = append(level, hashed)
+	}
+	for len(level) > 1 {
+		next := []*OTSTimestamp{}
+		for i := 0; i+1 < len(level); i += 2 {
+			left, right := level[i], level[i+1]
+			joined, err := left.addOp(OTSOp{Code: OTS_OP_APPEND, Arg: right.Msg})
+			if err != nil {
+				return nil, err
+			}
+			// Both sides end up at the same message, share the node
+			right.Ops = append(right.Ops, OTSOp{Code: OTS_OP_PREPEND, Arg: left.Msg, Next: joined})
+			parent, err := joined.addOp(OTSOp{Code: OTS_OP_SHA256})
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, parent)
+		}
+		// An odd one out moves up a level as is
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		level = next
+	}
+	return level[0], nil
+}
+
+// Submits the digest to all the calendars at once and merges their timestamps into one. At
+// least quorum calendars have to answer.
+func (o *OTSService) stampDigest(digest []byte, what string) (*OTSTimestamp, error) {
+	if len(o.calendars) == 0 {
+		return nil, errors.New("no OpenTimestamps calendars configured, add one with es ots calendar add <url>")
+	}
+	timestamps := make([]*OTSTimestamp, len(o.calendars))
+	errs := make([]error, len(o.calendars))
+	var wg sync.WaitGroup
+	for i, url := range o.calendars {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			timestamps[i], errs[i] = submitToCalendar(url, digest)
+		}(i, url)
+	}
+	wg.Wait()
+
+	root := &OTSTimestamp{Msg: digest}
+	num_ok := 0
+	failed := []string{}
+	for i, ts := range timestamps {
+		if errs[i] != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", o.calendars[i], errs[i]))
+			continue
+		}
+		if _, err := root.Merge(ts); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", o.calendars[i], err))
+			continue
+		}
+		num_ok++
+	}
+	quorum := o.quorum
+	if quorum < 1 {
+		quorum = 1
+	}
+	if num_ok < quorum {
+		return nil, fmt.Errorf("only %d of the %d calendars needed stamped %s: %s", num_ok, quorum, what, strings.Join(failed, ", "))
+	}
+	for _, msg := range failed {
+		log.Printf("calendar failed to stamp %s: %s", what, msg)
+	}
+
+	return root, nil
+}
+
+// Submits the digest to the calendar and returns the pending timestamp it made for it
+func submitToCalendar(url string, digest []byte) (*OTSTimestamp, error) {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(url, "/")+"/digest", bytes.NewReader(digest))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/vnd.opentimestamps.v1")
+	res, err := calendarClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("calendar replied %s", res.Status)
+	}
+	return parseOTSTimestamp(io.LimitReader(res.Body, 1<<20), digest)
+}
+
+// The attestation is complete once it has a bitcoin attestation
 func (o *OTSService) IsUpgraded(ev *nostr.Event) bool {
-	/*
-		bitcoinAttestationTag = mustDecodeHex("0588960d73d71901")
-		pendingAttestationTag = mustDecodeHex("83dfe30d2ef90c8e")
-	*/
-	bitcoinAttestationTag := "0588960d73d71901"
-	pendingAttestationTag := "83dfe30d2ef90c8e"
-	ots_b64 := ev.GetExtra("ots").(string)
-	ots, err := b64.StdEncoding.DecodeString(ots_b64)
-	if err != nil {
-		log.Panic(err.Error())
-	}
-	hx := hex.EncodeToString([]byte(ots))
-	found_bitcoin_tag := strings.Contains(hx, bitcoinAttestationTag)
-	found_pending_tag := strings.Contains(hx, pendingAttestationTag)
-	if found_bitcoin_tag && found_pending_tag {
-		log.Panicf("\nFound both ots tags for event id: %s", ev.ID)
-	}
-	if found_bitcoin_tag {
-		return true
-	}
-	if found_pending_tag {
+	info, err := inspectOTS(ev)
+	if err != nil {
 		return false
 	}
-	// This means we didn't find any of the tags...
-	log.Panicf("\nFound no ots tags for event id: %s", ev.ID)
+	return info.IsComplete()
+}
 
-	return false
+// Parses the detached timestamp in the ots field of the event
+func parseOTS(ev *nostr.Event) (*OTSFile, error) {
+	ots, err := b64.StdEncoding.DecodeString(ev.GetExtraString("ots"))
+	if err != nil {
+		return nil, fmt.Errorf("can't decode the ots field: %v", err)
+	}
+	f, err := parseOTSFile(bytes.NewReader(ots))
+	if err != nil {
+		return nil, fmt.Errorf("can't parse the ots field: %v", err)
+	}
+	return f, nil
+}
+
+func encodeOTS(f *OTSFile) string {
+	return b64.StdEncoding.EncodeToString(f.Serialize())
+}
+
+// The timestamp as go-opentimestamps sees it, for its verifiers
+func libraryTimestamp(f *OTSFile) (*opentimestamps.Timestamp, error) {
+	dts, err := opentimestamps.NewDetachedTimestampFromReader(bytes.NewReader(f.Serialize()))
+	if err != nil {
+		return nil, err
+	}
+	return dts.Timestamp, nil
 }
 
+// Checks the attestation commits to the event. Without this a relay could attach a valid
+// proof of any earlier event.
+func checkOTSDigest(ev *nostr.Event, f *OTSFile) error {
+	if digest := hex.EncodeToString(f.Digest()); digest != ev.GetID() {
+		return fmt.Errorf("the attestation is for %s, not this event", digest)
+	}
+	return nil
+}
+
+// Asks the calendar for the timestamp of a commitment it has pending
+func fetchCalendarTimestamp(uri string, msg []byte) (*OTSTimestamp, error) {
+	url := strings.TrimSuffix(uri, "/") + "/timestamp/" + hex.EncodeToString(msg)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/vnd.opentimestamps.v1")
+	res, err := calendarClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body := io.LimitReader(res.Body, 1<<20)
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(body)
+		return nil, fmt.Errorf("calendar %s replied %s: %s", uri, res.Status, msg)
+	}
+	return parseOTSTimestamp(body, msg)
+}
+
+// Asks the calendar for the timestamp of the commitment unless it already gave it to us
+func (o *OTSService) calendarTimestamp(uri string, msg []byte) (*OTSTimestamp, error) {
+	key := uri + "/" + hex.EncodeToString(msg)
+	if raw, ok := o.upgrades[key]; ok {
+		return parseOTSTimestamp(bytes.NewReader(raw), msg)
+	}
+	ts, err := fetchCalendarTimestamp(uri, msg)
+	if err != nil {
+		return nil, err
+	}
+	// Merging links the nodes into the event's tree, keep our own copy
+	buf := new(bytes.Buffer)
+	ts.serialize(buf)
+	if o.upgrades == nil {
+		o.upgrades = map[string][]byte{}
+	}
+	o.upgrades[key] = buf.Bytes()
+
+	return ts, nil
+}
+
+// Asks the calendars for the pending attestations of the event and merges what they return
+// into the event's ots field. A complete attestation is returned as is without asking anyone,
+// so once the upgraded event is saved, verifying it is local.
 func (o *OTSService) Upgrade(ev *nostr.Event) (*opentimestamps.Timestamp, error) {
-	ots_b64 := ev.GetExtra("ots").(string)
-	ots, err := b64.StdEncoding.DecodeString(ots_b64)
+	f, err := parseOTS(ev)
 	if err != nil {
-		log.Panic(err.Error())
+		return nil, err
+	}
+	info := inspectOTSFile(f)
+	if info.IsComplete() {
+		return libraryTimestamp(f)
 	}
-	ots_reader := bytes.NewReader(ots)
-	dts, _ := opentimestamps.NewDetachedTimestampFromReader(ots_reader)
 
-	var upgraded *opentimestamps.Timestamp
-	for _, pts := range opentimestamps.PendingTimestamps(dts.Timestamp) {
-		upgraded, err = pts.Upgrade()
+	// A calendar that still waits for the block decides over one we couldn't reach
+	var pending_err, calendar_err error
+	changed := false
+	for _, p := range info.Of(ATTESTATION_PENDING) {
+		upgraded, err := o.calendarTimestamp(p.URI, p.node.Msg)
 		if err != nil {
 			if strings.Contains(err.Error(), "Pending confirmation in Bitcoin blockchain") {
-				return nil, ErrOTSPending
+				if pending_err == nil {
+					pending_err = ErrOTSPending
+				}
 			} else if strings.Contains(err.Error(), "waiting for 5 confirmations") {
-				return nil, ErrOTSWaitingConfirmations
+				pending_err = ErrOTSWaitingConfirmations
 			} else {
-				return nil, err
+				calendar_err = err
 			}
+			continue
+		}
+		merged, err := p.node.Merge(upgraded)
+		if err != nil {
+			calendar_err = err
+			continue
 		}
-		// FIXME merge timestamp instead of replacing it
-		return upgraded, nil
+		changed = changed || merged
+	}
+	if changed {
+		ev.SetExtra("ots", encodeOTS(f))
+	}
+	if !inspectOTSFile(f).IsComplete() {
+		if pending_err != nil {
+			return nil, pending_err
+		}
+		if calendar_err != nil {
+			return nil, calendar_err
+		}
+		if changed {
+			return nil, ErrOTSPending
+		}
+		return nil, fmt.Errorf("OTS upgrade did not happen")
 	}
 
-	return nil, fmt.Errorf("OTS upgrade did not happen")
+	return libraryTimestamp(f)
 }
 
 func (o *OTSService) Verify(ev *nostr.Event) (bool, *time.Time, error) {
-	// TODO: When upgrading .ots, save it to prevent fetching it every time.
-	// This might require updating the go-opentimestamps lib
+	r := o.VerifyEvent(ev)
+	return r.IsGood(), r.AttestedTime, r.err
+}
+
+// Verifies the attestation of the event and says how it went
+func (o *OTSService) VerifyEvent(ev *nostr.Event) *OTSResult {
+	r := &OTSResult{EventID: ev.ID}
+	f, err := parseOTS(ev)
+	if err != nil {
+		return r.fail(OTS_STATUS_INVALID, err)
+	}
+	if err = checkOTSDigest(ev, f); err != nil {
+		return r.fail(OTS_STATUS_INVALID, err)
+	}
 	upgraded, err := o.Upgrade(ev)
 	if err != nil {
 		if err == ErrOTSPending {
-			return true, nil, err
+			r.Status, r.err = OTS_STATUS_PENDING, err
+			return r
 		}
 		if err == ErrOTSWaitingConfirmations {
-			return true, nil, err
+			r.Status, r.err = OTS_STATUS_WAITING, err
+			return r
 		}
-		return false, nil, err
+		return r.fail(OTS_STATUS_UNVERIFIABLE, err)
 	}
 
-	if o.rpcclient != nil {
-		return o.verifyRPC(upgraded)
-	}
-	// We have no bitcoin RPC client set. Query blockchain.info and output merkle root hashes
-	// for manual verification in case the site isn't trusted
-	return o.verifyManual(upgraded)
+	return o.verifyHeaders(upgraded, r)
 }
 
-func (o *OTSService) verifyRPC(upgraded *opentimestamps.Timestamp) (bool, *time.Time, error) {
-	if o.rpcclient == nil {
-		return false, nil, errors.New("Trying to verify OTS with RPC without RPC client set")
-	}
-	btcConn, err := newBtcConn(o.rpcclient.Host, o.rpcclient.User, o.rpcclient.Password)
+// Checks every bitcoin attestation of the timestamp against the merkle root of its block and
+// keeps the earliest block in the result
+func (o *OTSService) verifyHeaders(upgraded *opentimestamps.Timestamp, r *OTSResult) *OTSResult {
+	verifier := client.NewBitcoinAttestationVerifier(nil)
+	atts, err := verifier.VerifyManual(upgraded)
 	if err != nil {
-		return false, nil, fmt.Errorf("error creating btc connection: %v", err)
+		return r.fail(OTS_STATUS_INVALID, fmt.Errorf("error verifying timestamp: %v", err))
 	}
 
-	verifier := client.NewBitcoinAttestationVerifier(btcConn)
-	ts, err := verifier.Verify(upgraded)
-	if err != nil {
-		return false, nil, fmt.Errorf("error verifying timestamp: %v", err)
+	source := o.headers.Name()
+	if o.cross_check != nil {
+		source += " and " + o.cross_check.Name()
 	}
-	if ts == nil {
-		return false, nil, fmt.Errorf("no bitcoin-verifiable timestamps found")
+	for _, att := range atts {
+		// b2lx reverses in place and the message belongs to the timestamp
+		expected_merkle_root := b2lx(append([]byte{}, att.ExpectedMerkleRoot...))
+		header, err := o.headerAt(att.Height)
+		if errors.Is(err, ErrHeaderSourcesDisagree) {
+			return r.fail(OTS_STATUS_INVALID, err)
+		}
+		if err != nil {
+			return r.fail(OTS_STATUS_UNVERIFIABLE, err)
+		}
+		if header.MerkleRoot != expected_merkle_root {
+			return r.fail(OTS_STATUS_INVALID, fmt.Errorf("merkle root mismatch. Expected: %s, got: %s", expected_merkle_root, header.MerkleRoot))
+		}
+		ts := header.Time.UTC()
+		if r.AttestedTime == nil || ts.Before(*r.AttestedTime) {
+			r.AttestedTime = &ts
+			r.Height = att.Height
+			r.MerkleRoot = expected_merkle_root
+			r.Source = source
+		}
 	}
+	r.Status = OTS_STATUS_OK
 
-	return true, ts, nil
+	return r
 }
 
-// Make a GET request on blockchain.info to fetch the merkle root and verifies the expected merkle root against that
-func (o *OTSService) verifyManual(upgraded *opentimestamps.Timestamp) (bool, *time.Time, error) {
-	verifier := client.NewBitcoinAttestationVerifier(nil)
-	atts, err := verifier.VerifyManual(upgraded)
+// Gets the block header from the source and makes sure the cross-check source has the same one
+func (o *OTSService) headerAt(height uint64) (*BlockHeader, error) {
+	if header, ok := o.blocks[height]; ok {
+		return header, nil
+	}
+	if !o.network_checked {
+		if err := o.checkNetwork(); err != nil {
+			return nil, err
+		}
+	}
+	header, err := o.headers.HeaderAt(height)
+	if err != nil {
+		return nil, fmt.Errorf("can't get block %d from %s: %v", height, o.headers.Name(), err)
+	}
+	if o.cross_check == nil {
+		o.cacheHeader(header)
+		return header, nil
+	}
+	other, err := o.cross_check.HeaderAt(height)
 	if err != nil {
-		return false, nil, fmt.Errorf("error verifying timestamp: %v", err)
+		return nil, fmt.Errorf("can't cross-check block %d with %s: %v", height, o.cross_check.Name(), err)
 	}
+	if other.Hash != header.Hash || other.MerkleRoot != header.MerkleRoot || !other.Time.Equal(header.Time) {
+		return nil, fmt.Errorf("%w on block %d: %s has %s, %s has %s", ErrHeaderSourcesDisagree, height,
+			o.headers.Name(), header.Hash, o.cross_check.Name(), other.Hash)
+	}
+	o.cacheHeader(header)
 
-	// Make get requests on blockchain.info to verify against the merkle root
-	base_url := "https://blockchain.info/block-height/"
-	for _, att := range atts {
-		expected_mekle_root := b2lx(att.ExpectedMerkleRoot)
-		fmt.Printf("\nChecking if block at height: %d has merkle root: %s", att.Height, expected_mekle_root)
+	return header, nil
+}
 
-		url := fmt.Sprintf("%s%d%s", base_url, att.Height, "?format=json")
-		res, err := http.Get(url)
+// Makes sure the header sources start at the genesis block of our network. A mainnet api
+// can't verify regtest attestations and the other way around.
+func (o *OTSService) checkNetwork() error {
+	for _, src := range []BlockHeaderSource{o.headers, o.cross_check} {
+		if src == nil {
+			continue
+		}
+		genesis, err := src.HeaderAt(0)
 		if err != nil {
-			return false, nil, err
+			return fmt.Errorf("can't get the genesis block from %s: %v", src.Name(), err)
 		}
-		defer res.Body.Close()
-		body, readErr := ioutil.ReadAll(res.Body)
-		if readErr != nil {
-			log.Fatal(readErr)
+		if genesis.Hash != o.network.GenesisHash() {
+			return fmt.Errorf("%s is not on %s, its genesis block is %s", src.Name(), o.network.Name, genesis.Hash)
 		}
+	}
+	o.network_checked = true
 
-		// Read and compare merkle root
-		var result BlockchainInfoResp
-		json.Unmarshal(body, &result)
-		binfo_merkle_root := result.Blocks[0].MerkleRoot
-		if expected_mekle_root == binfo_merkle_root {
-			// Parse block timestamp from blockchain.info json
-			ts := time.Unix(int64(result.Blocks[0].Timestamp), 0).UTC()
-			return true, &ts, nil
-		} else {
-			return false, nil, fmt.Errorf("merkle root mismatch. Expected: %s, got: %s", expected_mekle_root, binfo_merkle_root)
-		}
+	return nil
+}
+
+func (o *OTSService) cacheHeader(header *BlockHeader) {
+	if o.blocks == nil {
+		o.blocks = map[uint64]*BlockHeader{}
 	}
+	o.blocks[header.Height] = header
+}
 
-	return true, nil, nil
+func (o *OTSService) HasTrustedHeaders() bool {
+	return !o.headers.IsRemote() || o.cross_check != nil
 }
 
-func (o *OTSService) HasRPCConfigured() bool {
-	return o.rpcclient != nil
+func (o *OTSService) AttestationSlack() time.Duration {
+	return o.slack
 }
 
 func newBtcConn(host, user, pass string) (*rpcclient.Client, error) {
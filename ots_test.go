@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// A calendar that answers like the public ones. Digests stay pending until confirm puts
+// them in a block.
+type calendarStandIn struct {
+	*httptest.Server
+	mu sync.Mutex
+	// Block height of every confirmed commitment, by commitment hex
+	confirmed map[string]uint64
+	pending   map[string]bool
+	submits   int
+	fetches   int
+	down      bool
+}
+
+func newCalendarStandIn() *calendarStandIn {
+	c := &calendarStandIn{confirmed: map[string]uint64{}, pending: map[string]bool{}}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.handle))
+	return c
+}
+
+func (c *calendarStandIn) handle(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/digest":
+		c.submits++
+		digest, _ := io.ReadAll(r.Body)
+		nonce := []byte("nonce")
+		commitment := sha256.Sum256(append(append([]byte{}, digest...), nonce...))
+		c.pending[hex.EncodeToString(commitment[:])] = true
+		// Append the nonce, hash and wait for a block
+		buf := new(bytes.Buffer)
+		buf.WriteByte(OTS_OP_APPEND)
+		writeVarBytes(buf, nonce)
+		buf.WriteByte(OTS_OP_SHA256)
+		buf.WriteByte(0x00)
+		buf.Write(OTSTagPending)
+		uri := new(bytes.Buffer)
+		writeVarBytes(uri, []byte(c.URL))
+		writeVarBytes(buf, uri.Bytes())
+		w.Write(buf.Bytes())
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/timestamp/"):
+		c.fetches++
+		commitment := strings.TrimPrefix(r.URL.Path, "/timestamp/")
+		height, ok := c.confirmed[commitment]
+		if !ok {
+			http.Error(w, "Pending confirmation in Bitcoin blockchain", http.StatusNotFound)
+			return
+		}
+		// The commitment hashes to the merkle root of the block
+		buf := new(bytes.Buffer)
+		buf.WriteByte(OTS_OP_SHA256)
+		buf.WriteByte(0x00)
+		buf.Write(OTSTagBitcoin)
+		h := new(bytes.Buffer)
+		writeVarUint(h, height)
+		writeVarBytes(buf, h.Bytes())
+		w.Write(buf.Bytes())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Puts every pending commitment into the block at the height and returns the headers the
+// attestations verify against
+func (c *calendarStandIn) confirm(headers *testHeaders, height uint64, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for commitment := range c.pending {
+		c.confirmed[commitment] = height
+		msg, _ := hex.DecodeString(commitment)
+		root := sha256.Sum256(msg)
+		headers.add(height, b2lx(root[:]), at)
+	}
+	c.pending = map[string]bool{}
+}
+
+// Block headers the test puts in, on top of the mainnet genesis block
+type testHeaders struct {
+	blocks map[uint64]*BlockHeader
+}
+
+func newTestHeaders() *testHeaders {
+	genesis := networks[NETWORK_MAINNET].params.GenesisBlock.Header
+	return &testHeaders{blocks: map[uint64]*BlockHeader{
+		0: {Height: 0, Hash: genesis.BlockHash().String(), MerkleRoot: genesis.MerkleRoot.String(), Time: genesis.Timestamp},
+	}}
+}
+
+// Several commitments can land in one block in the test, the last one wins
+func (h *testHeaders) add(height uint64, merkle_root string, at time.Time) {
+	h.blocks[height] = &BlockHeader{Height: height, Hash: fmt.Sprintf("%064x", height), MerkleRoot: merkle_root, Time: at}
+}
+
+func (h *testHeaders) Name() string {
+	return "test headers"
+}
+
+func (h *testHeaders) IsRemote() bool {
+	return false
+}
+
+func (h *testHeaders) HeaderAt(height uint64) (*BlockHeader, error) {
+	header, ok := h.blocks[height]
+	if !ok {
+		return nil, fmt.Errorf("no block %d", height)
+	}
+	return header, nil
+}
+
+func newTestOTS(headers BlockHeaderSource, quorum int, calendars ...*calendarStandIn) *OTSService {
+	urls := []string{}
+	for _, c := range calendars {
+		urls = append(urls, c.URL)
+	}
+	return &OTSService{
+		headers:   headers,
+		calendars: urls,
+		quorum:    quorum,
+		slack:     DEFAULT_ATTESTATION_SLACK,
+		network:   networks[NETWORK_MAINNET],
+	}
+}
+
+func newTestEvent(t *testing.T, content string) *nostr.Event {
+	priv_key := nostr.GeneratePrivateKey()
+	ev := &nostr.Event{
+		PubKey:    getPubKey(priv_key),
+		CreatedAt: time.Now(),
+		Kind:      nostr.KindTextNote,
+		Tags:      nostr.Tags{nostr.Tag{"prev", GENESIS}},
+		Content:   content,
+	}
+	if err := ev.Sign(priv_key); err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestCalendarStampAndUpgrade(t *testing.T) {
+	tests := []struct {
+		name      string
+		calendars int
+		down      int
+		quorum    int
+		err       string
+	}{
+		{"one calendar", 1, 0, 1, ""},
+		{"quorum of two", 2, 0, 2, ""},
+		{"one of two down", 2, 1, 1, ""},
+		{"quorum missed", 2, 1, 2, "only 1 of the 2 calendars needed"},
+		{"all down", 1, 1, 1, "only 0 of the 1 calendars needed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calendars := []*calendarStandIn{}
+			for i := 0; i < tt.calendars; i++ {
+				c := newCalendarStandIn()
+				defer c.Close()
+				c.down = i < tt.down
+				calendars = append(calendars, c)
+			}
+			headers := newTestHeaders()
+			ots := newTestOTS(headers, tt.quorum, calendars...)
+			ev := newTestEvent(t, "hello")
+
+			stamp, err := ots.Stamp(ev)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ev.SetExtra("ots", stamp)
+			if r := ots.VerifyEvent(ev); r.Status != OTS_STATUS_PENDING {
+				t.Fatalf("fresh stamp is %s: %s", r.Status, r.Error)
+			}
+
+			block_time := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+			for _, c := range calendars {
+				c.confirm(headers, 770000, block_time)
+			}
+			if _, err = ots.Upgrade(ev); err != nil {
+				t.Fatal(err)
+			}
+			if !ots.IsUpgraded(ev) {
+				t.Fatal("the attestation is not complete after the upgrade")
+			}
+			r := ots.VerifyEvent(ev)
+			if r.Status != OTS_STATUS_OK || r.Height != 770000 || !r.AttestedTime.Equal(block_time) {
+				t.Fatalf("verified as %s at %d %v: %s", r.Status, r.Height, r.AttestedTime, r.Error)
+			}
+
+			// The upgraded proof verifies without the calendars
+			for _, c := range calendars {
+				c.Close()
+			}
+			if r := newTestOTS(headers, 1).VerifyEvent(ev); r.Status != OTS_STATUS_OK {
+				t.Fatalf("upgraded proof is %s offline: %s", r.Status, r.Error)
+			}
+		})
+	}
+}
+
+func TestCalendarUnknownCommitmentStaysPending(t *testing.T) {
+	c := newCalendarStandIn()
+	defer c.Close()
+	headers := newTestHeaders()
+	ots := newTestOTS(headers, 1, c)
+	ev := newTestEvent(t, "hello")
+	stamp, err := ots.Stamp(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.SetExtra("ots", stamp)
+	before := ev.GetExtraString("ots")
+	if _, err = ots.Upgrade(ev); err != ErrOTSPending {
+		t.Fatalf("got %v, want %v", err, ErrOTSPending)
+	}
+	if ev.GetExtraString("ots") != before {
+		t.Fatal("a pending upgrade changed the proof")
+	}
+}
+
+func TestStampBatchUpgradesWithOneRequest(t *testing.T) {
+	c := newCalendarStandIn()
+	defer c.Close()
+	headers := newTestHeaders()
+	ots := newTestOTS(headers, 1, c)
+	evs := []*nostr.Event{}
+	for i := 0; i < 5; i++ {
+		evs = append(evs, newTestEvent(t, fmt.Sprintf("event %d", i)))
+	}
+
+	stamps, err := ots.StampBatch(evs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.submits != 1 {
+		t.Fatalf("the batch was submitted %d times", c.submits)
+	}
+	c.confirm(headers, 770001, time.Now())
+	for i, ev := range evs {
+		ev.SetExtra("ots", stamps[i])
+		if r := ots.VerifyEvent(ev); r.Status != OTS_STATUS_OK || r.Height != 770001 {
+			t.Fatalf("event %d verified as %s: %s", i, r.Status, r.Error)
+		}
+	}
+	if c.fetches != 1 {
+		t.Fatalf("the calendar was asked %d times", c.fetches)
+	}
+}
+
+func TestVerifyEventRejectsProofOfAnotherEvent(t *testing.T) {
+	c := newCalendarStandIn()
+	defer c.Close()
+	headers := newTestHeaders()
+	ots := newTestOTS(headers, 1, c)
+	stamped := newTestEvent(t, "stamped")
+	stamp, err := ots.Stamp(stamped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.confirm(headers, 770002, time.Now())
+
+	tests := []struct {
+		name   string
+		ev     *nostr.Event
+		status string
+	}{
+		{"own proof", stamped, OTS_STATUS_OK},
+		{"proof of another event", newTestEvent(t, "not stamped"), OTS_STATUS_INVALID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ev.SetExtra("ots", stamp)
+			r := ots.VerifyEvent(tt.ev)
+			if r.Status != tt.status {
+				t.Fatalf("verified as %s, want %s: %s", r.Status, tt.status, r.Error)
+			}
+			if is_good, _, _ := ots.Verify(tt.ev); is_good != (tt.status == OTS_STATUS_OK) {
+				t.Fatalf("Verify says %v", is_good)
+			}
+		})
+	}
+}
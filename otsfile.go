@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/ripemd160"
+	"golang.org/x/crypto/sha3"
+)
+
+// Reading and writing of .ots files. go-opentimestamps can't merge timestamps since it keeps
+// their operations private, and it writes a node with more than one attestation wrongly. We
+// need both to keep upgraded proofs, so the format is handled here. The library is still
+// used to submit to the calendars and to verify the bitcoin attestations.
+//
+// A timestamp is a tree. Every node holds a message, the attestations of that message and the
+// operations that lead to the messages of its child nodes.
+
+var otsMagic = []byte("\x00OpenTimestamps\x00\x00Proof\x00\xbf\x89\xe2\xe8\x84\xe8\x92\x94")
+
+const (
+	OTS_MAJOR_VERSION  = 1
+	otsMaxMessage      = 4096
+	otsMaxPayload      = 8192
+	otsRecursionLimit  = 256
+	otsAttestationSize = 8
+)
+
+var (
+	OTSTagBitcoin = mustDecodeHex("0588960d73d71901")
+	OTSTagPending = mustDecodeHex("83dfe30d2ef90c8e")
+)
+
+// Operation codes
+const (
+	OTS_OP_SHA1      = 0x02
+	OTS_OP_RIPEMD160 = 0x03
+	OTS_OP_SHA256    = 0x08
+	OTS_OP_KECCAK256 = 0x67
+	OTS_OP_APPEND    = 0xf0
+	OTS_OP_PREPEND   = 0xf1
+	OTS_OP_REVERSE   = 0xf2
+	OTS_OP_HEXLIFY   = 0xf3
+)
+
+var otsOpNames = map[byte]string{
+	OTS_OP_SHA1:      "sha1",
+	OTS_OP_RIPEMD160: "ripemd160",
+	OTS_OP_SHA256:    "sha256",
+	OTS_OP_KECCAK256: "keccak256",
+	OTS_OP_APPEND:    "append",
+	OTS_OP_PREPEND:   "prepend",
+	OTS_OP_REVERSE:   "reverse",
+	OTS_OP_HEXLIFY:   "hexlify",
+}
+
+// A detached timestamp, the content of a .ots file
+type OTSFile struct {
+	// The hash operation the file digest was made with
+	HashOp    byte
+	Timestamp *OTSTimestamp
+}
+
+type OTSTimestamp struct {
+	Msg          []byte
+	Attestations []OTSAttestation
+	Ops          []OTSOp
+}
+
+type OTSAttestation struct {
+	Tag     []byte
+	Payload []byte
+}
+
+type OTSOp struct {
+	Code byte
+	// Only append and prepend have an argument
+	Arg  []byte
+	Next *OTSTimestamp
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (f *OTSFile) Digest() []byte {
+	return f.Timestamp.Msg
+}
+
+func (a *OTSAttestation) IsBitcoin() bool {
+	return bytes.Equal(a.Tag, OTSTagBitcoin)
+}
+
+func (a *OTSAttestation) IsPending() bool {
+	return bytes.Equal(a.Tag, OTSTagPending)
+}
+
+// Block height of a bitcoin attestation
+func (a *OTSAttestation) Height() (uint64, error) {
+	return readVarUint(bytes.NewReader(a.Payload))
+}
+
+// Calendar url of a pending attestation
+func (a *OTSAttestation) URI() (string, error) {
+	uri, err := readVarBytes(bytes.NewReader(a.Payload), otsMaxPayload)
+	return string(uri), err
+}
+
+func (a *OTSAttestation) String() string {
+	switch {
+	case a.IsBitcoin():
+		height, _ := a.Height()
+		return fmt.Sprintf("BitcoinBlockHeaderAttestation(%d)", height)
+	case a.IsPending():
+		uri, _ := a.URI()
+		return fmt.Sprintf("PendingAttestation('%s')", uri)
+	}
+	return fmt.Sprintf("UnknownAttestation(%x, %x)", a.Tag, a.Payload)
+}
+
+func (op *OTSOp) Name() string {
+	if name, ok := otsOpNames[op.Code]; ok {
+		return name
+	}
+	return fmt.Sprintf("op(%02x)", op.Code)
+}
+
+// Applies the operation to a message
+func (op *OTSOp) Apply(msg []byte) ([]byte, error) {
+	var result []byte
+	switch op.Code {
+	case OTS_OP_SHA1:
+		h := sha1.Sum(msg)
+		result = h[:]
+	case OTS_OP_RIPEMD160:
+		h := ripemd160.New()
+		h.Write(msg)
+		result = h.Sum(nil)
+	case OTS_OP_SHA256:
+		h := sha256.Sum256(msg)
+		result = h[:]
+	case OTS_OP_KECCAK256:
+		h := sha3.NewLegacyKeccak256()
+		h.Write(msg)
+		result = h.Sum(nil)
+	case OTS_OP_APPEND:
+		result = append(append([]byte{}, msg...), op.Arg...)
+	case OTS_OP_PREPEND:
+		result = append(append([]byte{}, op.Arg...), msg...)
+	case OTS_OP_REVERSE:
+		result = make([]byte, len(msg))
+		for i := range msg {
+			result[i] = msg[len(msg)-1-i]
+		}
+	case OTS_OP_HEXLIFY:
+		result = []byte(hex.EncodeToString(msg))
+	default:
+		return nil, fmt.Errorf("unknown operation %02x", op.Code)
+	}
+	if len(result) > otsMaxMessage {
+		return nil, errors.New("message too long")
+	}
+	return result, nil
+}
+
+// Merges another timestamp of the same message into this one. Attestations and operations
+// we don't have yet are added, operations we have are merged recursively. Returns whether
+// anything was added.
+func (t *OTSTimestamp) Merge(other *OTSTimestamp) (bool, error) {
+	if !bytes.Equal(t.Msg, other.Msg) {
+		return false, errors.New("can't merge timestamps of different messages")
+	}
+	changed := false
+	for _, att := range other.Attestations {
+		if !t.hasAttestation(att) {
+			t.Attestations = append(t.Attestations, att)
+			changed = true
+		}
+	}
+	for _, op := range other.Ops {
+		if own := t.findOp(op); own != nil {
+			c, err := own.Next.Merge(op.Next)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+			continue
+		}
+		t.Ops = append(t.Ops, op)
+		changed = true
+	}
+	return changed, nil
+}
+
+// Adds the operation to the node and returns the node of its result
+func (t *OTSTimestamp) addOp(op OTSOp) (*OTSTimestamp, error) {
+	msg, err := op.Apply(t.Msg)
+	if err != nil {
+		return nil, err
+	}
+	op.Next = &OTSTimestamp{Msg: msg}
+	t.Ops = append(t.Ops, op)
+	return op.Next, nil
+}
+
+func (t *OTSTimestamp) hasAttestation(att OTSAttestation) bool {
+	for _, own := range t.Attestations {
+		if bytes.Equal(own.Tag, att.Tag) && bytes.Equal(own.Payload, att.Payload) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *OTSTimestamp) findOp(op OTSOp) *OTSOp {
+	for i := range t.Ops {
+		if t.Ops[i].Code == op.Code && bytes.Equal(t.Ops[i].Arg, op.Arg) {
+			return &t.Ops[i]
+		}
+	}
+	return nil
+}
+
+// Parses a .ots file
+func parseOTSFile(r io.Reader) (*OTSFile, error) {
+	magic := make([]byte, len(otsMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, otsMagic) {
+		return nil, errors.New("not an ots file")
+	}
+	version, err := readVarUint(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != OTS_MAJOR_VERSION {
+		return nil, fmt.Errorf("unsupported ots version %d", version)
+	}
+	hash_op, err := readByte(r)
+	if err != nil {
+		return nil, err
+	}
+	var size int
+	switch hash_op {
+	case OTS_OP_SHA1, OTS_OP_RIPEMD160:
+		size = 20
+	case OTS_OP_SHA256, OTS_OP_KECCAK256:
+		size = 32
+	default:
+		return nil, fmt.Errorf("unknown file hash operation %02x", hash_op)
+	}
+	digest := make([]byte, size)
+	if _, err := io.ReadFull(r, digest); err != nil {
+		return nil, err
+	}
+	ts, err := parseOTSTimestamp(r, digest)
+	if err != nil {
+		return nil, err
+	}
+	// Anything after the timestamp means it's not what we think it is
+	if _, err := readByte(r); err != io.EOF {
+		return nil, errors.New("trailing data after the timestamp")
+	}
+
+	return &OTSFile{HashOp: hash_op, Timestamp: ts}, nil
+}
+
+// Parses a serialized timestamp of the message, e.g. what a calendar returns
+func parseOTSTimestamp(r io.Reader, msg []byte) (*OTSTimestamp, error) {
+	return parseOTSNode(r, msg, otsRecursionLimit)
+}
+
+func parseOTSNode(r io.Reader, msg []byte, limit int) (*OTSTimestamp, error) {
+	if limit == 0 {
+		return nil, errors.New("timestamp is too deep")
+	}
+	t := &OTSTimestamp{Msg: msg}
+	for {
+		tag, err := readByte(r)
+		if err != nil {
+			return nil, err
+		}
+		last := tag != 0xff
+		if !last {
+			if tag, err = readByte(r); err != nil {
+				return nil, err
+			}
+		}
+		if err := t.parseItem(r, tag, limit); err != nil {
+			return nil, err
+		}
+		if last {
+			return t, nil
+		}
+	}
+}
+
+func (t *OTSTimestamp) parseItem(r io.Reader, tag byte, limit int) error {
+	if tag == 0x00 {
+		att_tag := make([]byte, otsAttestationSize)
+		if _, err := io.ReadFull(r, att_tag); err != nil {
+			return err
+		}
+		payload, err := readVarBytes(r, otsMaxPayload)
+		if err != nil {
+			return err
+		}
+		t.Attestations = append(t.Attestations, OTSAttestation{Tag: att_tag, Payload: payload})
+		return nil
+	}
+
+	op := OTSOp{Code: tag}
+	if _, ok := otsOpNames[tag]; !ok {
+		return fmt.Errorf("unknown operation %02x", tag)
+	}
+	if tag == OTS_OP_APPEND || tag == OTS_OP_PREPEND {
+		arg, err := readVarBytes(r, otsMaxMessage)
+		if err != nil {
+			return err
+		}
+		op.Arg = arg
+	}
+	next_msg, err := op.Apply(t.Msg)
+	if err != nil {
+		return err
+	}
+	op.Next, err = parseOTSNode(r, next_msg, limit-1)
+	if err != nil {
+		return err
+	}
+	t.Ops = append(t.Ops, op)
+	return nil
+}
+
+func (f *OTSFile) Serialize() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(otsMagic)
+	writeVarUint(buf, OTS_MAJOR_VERSION)
+	buf.WriteByte(f.HashOp)
+	buf.Write(f.Timestamp.Msg)
+	f.Timestamp.serialize(buf)
+	return buf.Bytes()
+}
+
+// Writes the attestations and then the operations, each sorted so the same timestamp is
+// always written the same way. Every item but the last is marked with 0xff.
+func (t *OTSTimestamp) serialize(buf *bytes.Buffer) {
+	atts := append([]OTSAttestation{}, t.Attestations...)
+	key := func(att OTSAttestation) []byte {
+		return append(append([]byte{}, att.Tag...), att.Payload...)
+	}
+	sort.Slice(atts, func(i, j int) bool {
+		return bytes.Compare(key(atts[i]), key(atts[j])) < 0
+	})
+	ops := append([]OTSOp{}, t.Ops...)
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Code != ops[j].Code {
+			return ops[i].Code < ops[j].Code
+		}
+		return bytes.Compare(ops[i].Arg, ops[j].Arg) < 0
+	})
+
+	items := len(atts) + len(ops)
+	for _, att := range atts {
+		items--
+		if items > 0 {
+			buf.WriteByte(0xff)
+		}
+		buf.WriteByte(0x00)
+		buf.Write(att.Tag)
+		writeVarBytes(buf, att.Payload)
+	}
+	for _, op := range ops {
+		items--
+		if items > 0 {
+			buf.WriteByte(0xff)
+		}
+		buf.WriteByte(op.Code)
+		if op.Code == OTS_OP_APPEND || op.Code == OTS_OP_PREPEND {
+			writeVarBytes(buf, op.Arg)
+		}
+		op.Next.serialize(buf)
+	}
+}
+
+func readByte(r io.Reader) (byte, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func readVarUint(r io.Reader) (uint64, error) {
+	var value uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := readByte(r)
+		if err != nil {
+			return 0, err
+		}
+		value |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("varuint too long")
+}
+
+func readVarBytes(r io.Reader, max int) ([]byte, error) {
+	size, err := readVarUint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(max) {
+		return nil, fmt.Errorf("%d bytes is more than the %d allowed", size, max)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeVarUint(buf *bytes.Buffer, value uint64) {
+	for value >= 0x80 {
+		buf.WriteByte(byte(value) | 0x80)
+		value >>= 7
+	}
+	buf.WriteByte(byte(value))
+}
+
+func writeVarBytes(buf *bytes.Buffer, b []byte) {
+	writeVarUint(buf, uint64(len(b)))
+	buf.Write(b)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readOTSFixture(t *testing.T, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", "ots", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Files made by the reference client, see testdata/ots
+func TestOTSFileRoundTrip(t *testing.T) {
+	tests := []struct {
+		file     string
+		summary  string
+		complete bool
+	}{
+		{"hello-world.txt.ots", "bitcoin block 358391", true},
+		{"incomplete.txt.ots", "pending at https://alice.btc.calendar.opentimestamps.org", false},
+		{"two-calendars.txt.ots", "pending at 2 calendars", false},
+		{"known-and-unknown-notary.txt.ots", "pending at https://bob.btc.calendar.opentimestamps.org, 1 unknown", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data := readOTSFixture(t, tt.file)
+			f, err := parseOTSFile(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(f.Serialize(), data) {
+				t.Fatal("the file serializes differently")
+			}
+			info := inspectOTSFile(f)
+			if info.Summary() != tt.summary || info.IsComplete() != tt.complete {
+				t.Fatalf("got %q complete %v", info.Summary(), info.IsComplete())
+			}
+		})
+	}
+
+	f, _ := parseOTSFile(bytes.NewReader(readOTSFixture(t, "hello-world.txt.ots")))
+	// sha256 of "Hello World!\n"
+	if digest := hex.EncodeToString(f.Digest()); digest != "03ba204e50d126e4674c005e04d82e84c21366780af1f43bd54a37816b6ab340" {
+		t.Fatalf("digest is %s", digest)
+	}
+}
+
+func TestOTSFileRejects(t *testing.T) {
+	valid := readOTSFixture(t, "incomplete.txt.ots")
+	header := len(otsMagic) + 2 + 32
+	with := func(i int, b byte) []byte {
+		data := append([]byte{}, valid...)
+		data[i] = b
+		return data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", []byte{}, "not an ots file"},
+		{"wrong magic", with(0, 0x01), "not an ots file"},
+		{"unsupported version", with(len(otsMagic), 0x02), "unsupported ots version"},
+		{"unknown hash", with(len(otsMagic)+1, 0x42), "unknown file hash operation"},
+		{"unknown operation", with(header, 0x42), "unknown operation"},
+		{"truncated", valid[:len(valid)-3], "EOF"},
+		{"trailing data", append(append([]byte{}, valid...), 0x00), "trailing data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOTSFile(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func pendingAt(t *testing.T, msg []byte, calendar string) *OTSTimestamp {
+	root := &OTSTimestamp{Msg: msg}
+	next, err := root.addOp(OTSOp{Code: OTS_OP_APPEND, Arg: []byte(calendar)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err = next.addOp(OTSOp{Code: OTS_OP_SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := new(bytes.Buffer)
+	writeVarBytes(uri, []byte(calendar))
+	next.Attestations = append(next.Attestations, OTSAttestation{Tag: OTSTagPending, Payload: uri.Bytes()})
+	return root
+}
+
+func TestOTSTimestampMerge(t *testing.T) {
+	msg := bytes.Repeat([]byte{0xab}, 32)
+	ts := pendingAt(t, msg, "https://a.example")
+
+	tests := []struct {
+		name    string
+		other   *OTSTimestamp
+		changed bool
+		pending int
+		err     bool
+	}{
+		{"same calendar", pendingAt(t, msg, "https://a.example"), false, 1, false},
+		{"another calendar", pendingAt(t, msg, "https://b.example"), true, 2, false},
+		{"both again", pendingAt(t, msg, "https://b.example"), false, 2, false},
+		{"another message", pendingAt(t, bytes.Repeat([]byte{0xcd}, 32), "https://c.example"), false, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, err := ts.Merge(tt.other)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if changed != tt.changed {
+				t.Fatalf("changed is %v", changed)
+			}
+			// The merged timestamp survives a round trip
+			f := &OTSFile{HashOp: OTS_OP_SHA256, Timestamp: ts}
+			parsed, err := parseOTSFile(bytes.NewReader(f.Serialize()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(inspectOTSFile(parsed).Of(ATTESTATION_PENDING)); n != tt.pending {
+				t.Fatalf("%d pending attestations, want %d", n, tt.pending)
+			}
+		})
+	}
+}
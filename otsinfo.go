@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	ATTESTATION_BITCOIN = "bitcoin"
+	ATTESTATION_PENDING = "pending"
+	ATTESTATION_UNKNOWN = "unknown"
+)
+
+// An attestation found in a proof and how the digest gets to the message it attests
+type AttestationInfo struct {
+	Kind string `json:"kind"`
+	// Calendar of a pending attestation
+	URI string `json:"uri,omitempty"`
+	// Block of a bitcoin attestation
+	Height uint64 `json:"height,omitempty"`
+	// Tag and payload of an attestation we don't know
+	Tag     string   `json:"tag,omitempty"`
+	Payload string   `json:"payload,omitempty"`
+	Msg     string   `json:"msg"`
+	Path    []string `json:"path"`
+	// The node the attestation is on, upgrades are merged into it
+	node *OTSTimestamp
+}
+
+// What the ots field of an event attests
+type OTSProofInfo struct {
+	Digest       string            `json:"digest"`
+	Attestations []AttestationInfo `json:"attestations"`
+}
+
+// Walks the proof of the event and reports every attestation in it
+func inspectOTS(ev *nostr.Event) (*OTSProofInfo, error) {
+	f, err := parseOTS(ev)
+	if err != nil {
+		return nil, err
+	}
+	return inspectOTSFile(f), nil
+}
+
+func inspectOTSFile(f *OTSFile) *OTSProofInfo {
+	info := &OTSProofInfo{Digest: hex.EncodeToString(f.Digest()), Attestations: []AttestationInfo{}}
+	var walk func(node *OTSTimestamp, path []string)
+	walk = func(node *OTSTimestamp, path []string) {
+		for _, att := range node.Attestations {
+			a := AttestationInfo{Msg: hex.EncodeToString(node.Msg), Path: path, node: node}
+			switch {
+			case att.IsBitcoin():
+				height, err := att.Height()
+				if err != nil {
+					a.Kind = ATTESTATION_UNKNOWN
+					break
+				}
+				a.Kind = ATTESTATION_BITCOIN
+				a.Height = height
+			case att.IsPending():
+				uri, err := att.URI()
+				if err != nil {
+					a.Kind = ATTESTATION_UNKNOWN
+					break
+				}
+				a.Kind = ATTESTATION_PENDING
+				a.URI = uri
+			default:
+				a.Kind = ATTESTATION_UNKNOWN
+			}
+			if a.Kind == ATTESTATION_UNKNOWN {
+				a.Tag = hex.EncodeToString(att.Tag)
+				a.Payload = hex.EncodeToString(att.Payload)
+			}
+			info.Attestations = append(info.Attestations, a)
+		}
+		for _, op := range node.Ops {
+			step := op.Name()
+			if op.Code == OTS_OP_APPEND || op.Code == OTS_OP_PREPEND {
+				step += " " + hex.EncodeToString(op.Arg)
+			}
+			// Copy so sibling branches don't share the backing array
+			walk(op.Next, append(append([]string{}, path...), step))
+		}
+	}
+	walk(f.Timestamp, []string{})
+
+	return info
+}
+
+func (p *OTSProofInfo) Of(kind string) []AttestationInfo {
+	atts := []AttestationInfo{}
+	for _, att := range p.Attestations {
+		if att.Kind == kind {
+			atts = append(atts, att)
+		}
+	}
+	return atts
+}
+
+// The proof is complete once it reaches a bitcoin block
+func (p *OTSProofInfo) IsComplete() bool {
+	return len(p.Of(ATTESTATION_BITCOIN)) > 0
+}
+
+// One line about the attestations, e.g. "bitcoin block 826112, pending at 2 calendars"
+func (p *OTSProofInfo) Summary() string {
+	parts := []string{}
+	for _, att := range p.Of(ATTESTATION_BITCOIN) {
+		parts = append(parts, fmt.Sprintf("bitcoin block %d", att.Height))
+	}
+	if pending := p.Of(ATTESTATION_PENDING); len(pending) == 1 {
+		parts = append(parts, "pending at "+pending[0].URI)
+	} else if len(pending) > 1 {
+		parts = append(parts, fmt.Sprintf("pending at %d calendars", len(pending)))
+	}
+	if unknown := p.Of(ATTESTATION_UNKNOWN); len(unknown) > 0 {
+		parts = append(parts, fmt.Sprintf("%d unknown", len(unknown)))
+	}
+	if len(parts) == 0 {
+		return "no attestations"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (p *OTSProofInfo) Print() {
+	fmt.Printf("Digest: %s\n", p.Digest)
+	for _, att := range p.Attestations {
+		switch att.Kind {
+		case ATTESTATION_BITCOIN:
+			fmt.Printf("\nBitcoin block %d\n", att.Height)
+		case ATTESTATION_PENDING:
+			fmt.Printf("\nPending at %s\n", att.URI)
+		default:
+			fmt.Printf("\nUnknown attestation %s: %s\n", att.Tag, att.Payload)
+		}
+		for _, step := range att.Path {
+			fmt.Printf("  %s\n", step)
+		}
+		fmt.Printf("  -> %s\n", att.Msg)
+	}
+	status := "pending"
+	if p.IsComplete() {
+		status = "complete"
+	}
+	fmt.Printf("\nStatus: %s (%s)\n", status, p.Summary())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	OTS_STATUS_OK      = "ok"
+	OTS_STATUS_PENDING = "pending"
+	OTS_STATUS_WAITING = "waiting_confirmations"
+	// The proof is wrong, e.g. it commits to a merkle root the block doesn't have
+	OTS_STATUS_INVALID = "invalid"
+	// We couldn't check the proof, e.g. a calendar or the block header source is down
+	OTS_STATUS_UNVERIFIABLE = "unverifiable"
+)
+
+// The outcome of verifying the attestation of an event. Height, merkle root and source are of
+// the earliest block the event is attested in.
+type OTSResult struct {
+	EventID      string     `json:"event_id"`
+	Status       string     `json:"status"`
+	AttestedTime *time.Time `json:"attested_time,omitempty"`
+	Height       uint64     `json:"height,omitempty"`
+	MerkleRoot   string     `json:"merkle_root,omitempty"`
+	Source       string     `json:"source,omitempty"`
+	// Set when the attested time doesn't follow the chain, see AttestationOrder
+	NonMonotonic bool   `json:"non_monotonic,omitempty"`
+	Error        string `json:"error,omitempty"`
+	err          error
+}
+
+func (r *OTSResult) fail(status string, err error) *OTSResult {
+	r.Status = status
+	r.Error = err.Error()
+	r.err = err
+	return r
+}
+
+// Pending attestations are fine, they just aren't in a block yet
+func (r *OTSResult) IsGood() bool {
+	return r.Status == OTS_STATUS_OK || r.Status == OTS_STATUS_PENDING || r.Status == OTS_STATUS_WAITING
+}
+
+// The results of all the events of a stream. The stream is OK when every attestation is good
+// and they are attested in the order of the stream.
+type OTSReport struct {
+	Name         string       `json:"name"`
+	PubKey       string       `json:"pubkey"`
+	Results      []*OTSResult `json:"results"`
+	Verified     int          `json:"verified"`
+	Pending      int          `json:"pending"`
+	Failed       int          `json:"failed"`
+	NonMonotonic int          `json:"non_monotonic"`
+	// Whether the block headers came from a source we trust
+	TrustedHeaders bool `json:"trusted_headers"`
+	OK             bool `json:"ok"`
+}
+
+func (r *OTSReport) add(result *OTSResult) {
+	r.Results = append(r.Results, result)
+	switch {
+	case result.Status == OTS_STATUS_OK:
+		r.Verified++
+	case result.IsGood():
+		r.Pending++
+	default:
+		r.Failed++
+		r.OK = false
+	}
+}
+
+func (r *OTSResult) Print(show_merkle_root bool) {
+	status := "FAIL"
+	if r.IsGood() {
+		status = "OK"
+	}
+	switch r.Status {
+	case OTS_STATUS_PENDING:
+		fmt.Printf("Event id: %s: Status: %s (PENDING)\n", r.EventID, status)
+	case OTS_STATUS_WAITING:
+		fmt.Printf("Event id: %s: Status: %s (WAITING 5 CONFIRMATIONS)\n", r.EventID, status)
+	case OTS_STATUS_OK:
+		if r.AttestedTime != nil {
+			fmt.Printf("Event id: %s: Status: %s (%s)\n", r.EventID, status, r.AttestedTime)
+		} else {
+			fmt.Printf("Event id: %s: Status: %s\n", r.EventID, status)
+		}
+		if show_merkle_root {
+			fmt.Printf("  block %d has merkle root %s according to %s\n", r.Height, r.MerkleRoot, r.Source)
+		}
+	default:
+		fmt.Printf("Event id: %s: Status: %s (%s). Error: %s\n", r.EventID, status, r.Status, r.Error)
+	}
+	if r.NonMonotonic {
+		fmt.Printf("  Error: %s\n", r.Error)
+	}
+}
+
+func (r *OTSReport) Print() {
+	for _, result := range r.Results {
+		result.Print(!r.TrustedHeaders)
+	}
+	fmt.Printf("\n%d verified, %d pending, %d failed, %d attested out of order\n", r.Verified, r.Pending, r.Failed, r.NonMonotonic)
+	if !r.TrustedHeaders {
+		fmt.Println("NOTE: In case you don't trust the block header source, verify the merkle root hashes manually or cross-check them with another source.")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Scripts can pass the passphrase through this environment variable instead of typing it
+const PASSPHRASE_ENV = "ES_PASSPHRASE"
+
+// Shared so that secrets piped line by line through stdin are not lost to buffering
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// Reads a passphrase from the environment, the terminal or stdin, in that order. When
+// confirm is set, a passphrase typed on the terminal has to be typed twice.
+func readPassphrase(prompt string, confirm bool) (string, error) {
+	if passphrase, ok := os.LookupEnv(PASSPHRASE_ENV); ok {
+		return passphrase, nil
+	}
+	return readSecret(prompt, confirm)
+}
+
+// Reads a secret from the terminal without echoing it or, if stdin is not a terminal, a
+// single line from stdin
+func readSecret(prompt string, confirm bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := stdinReader.ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("can't read from stdin: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(secret) {
+			return "", errors.New("the entries don't match")
+		}
+	}
+
+	return string(secret), nil
+}
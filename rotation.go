@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// A stolen key can be revoked with an event in the stream itself. The revocation is signed by
+// the current key and either closes the stream for good or names a successor key. The
+// successor continues the stream with a link event that points back to the revoked key, which
+// proves the successor agreed to take over. Only the successor can sign after that.
+const (
+	KindKeyRevocation = 4150
+	KindKeyLink       = 4151
+)
+
+func get_successor(evt nostr.Event) string {
+	for _, tag := range evt.Tags {
+		if tag.Key() == "successor" {
+			return tag.Value()
+		}
+	}
+
+	return ""
+}
+
+func get_predecessor(evt nostr.Event) string {
+	for _, tag := range evt.Tags {
+		if tag.Key() == "predecessor" {
+			return tag.Value()
+		}
+	}
+
+	return ""
+}
+
+// Walks the main chain of the stream and returns the key that signs it, the successor named
+// by a revocation that wasn't linked yet and whether the stream was closed by a revocation
+func (es *EventStream) keyState() (string, string, bool) {
+	return keyStateOf(es.PubKey, es.Log)
+}
+
+// Same as keyState for a chain of events of the stream that starts with the pubkey
+func keyStateOf(pubkey string, chain []nostr.Event) (string, string, bool) {
+	current := pubkey
+	successor := ""
+	closed := false
+	for _, ev := range chain {
+		switch ev.Kind {
+		case KindKeyRevocation:
+			successor = get_successor(ev)
+			closed = successor == ""
+		case KindKeyLink:
+			current = ev.PubKey
+			successor = ""
+		}
+	}
+
+	return current, successor, closed
+}
+
+// The key the next event of the stream has to be signed with
+func (es *EventStream) SignerPubKey() string {
+	current, successor, _ := es.keyState()
+	if successor != "" {
+		return successor
+	}
+	return current
+}
+
+// A revoked stream doesn't accept any more events
+func (es *EventStream) IsRevoked() bool {
+	_, _, closed := es.keyState()
+	return closed
+}
+
+// Checks the event that extends the chain is signed by the right key and follows the rules
+// of key rotation
+func (es *EventStream) checkKeyRules(chain []nostr.Event, ev nostr.Event) error {
+	current, successor, closed := keyStateOf(es.PubKey, chain)
+	if closed {
+		return fmt.Errorf("the key of %s was revoked, the stream doesn't accept events anymore", es.Name)
+	}
+	if successor != "" {
+		if ev.PubKey != successor {
+			return fmt.Errorf("the key of %s was rotated, expected an event from %s got %s", es.Name, successor, ev.PubKey)
+		}
+		if ev.Kind != KindKeyLink || get_predecessor(ev) != current {
+			return fmt.Errorf("the first event of the successor key of %s must link back to %s", es.Name, current)
+		}
+		return nil
+	}
+	if ev.PubKey != current {
+		return fmt.Errorf("can't append event from pubkey %s to stream with pubkey %s", ev.PubKey, current)
+	}
+	switch ev.Kind {
+	case KindKeyLink:
+		return fmt.Errorf("event %s links a key that was never named as a successor", ev.ID)
+	case KindKeyRevocation:
+		next := get_successor(ev)
+		if next != "" && (!isHexKey(next) || next == current) {
+			return fmt.Errorf("revocation %s names an invalid successor %s", ev.ID, next)
+		}
+	}
+
+	return nil
+}
+
+// Revokes the key that signs the stream. Without a successor the stream is closed.
+func (es *EventStream) Revoke(reason string, successor string, signer Signer, ots Timestamper) (*nostr.Event, error) {
+	tags := nostr.Tags{}
+	if successor != "" {
+		tags = append(tags, nostr.Tag{"successor", successor})
+	}
+	return es.createEvent(KindKeyRevocation, reason, tags, signer, ots)
+}
+
+// Continues the stream under the successor key named by the last revocation
+func (es *EventStream) LinkSuccessor(signer Signer, ots Timestamper) (*nostr.Event, error) {
+	current, successor, _ := es.keyState()
+	if successor == "" {
+		return nil, fmt.Errorf("%s has no successor key to link", es.Name)
+	}
+	return es.createEvent(KindKeyLink, "", nostr.Tags{nostr.Tag{"predecessor", current}}, signer, ots)
+}
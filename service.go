@@ -1,18 +1,306 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
 type StreamService struct {
 	store  StreamStore
 	config *Config
 	ots    *OTSService
+	lock   *DataDirLock
 }
 
 func (s *StreamService) Load() {
 	cfg := Config{}
 	cfg.Load()
-	store := LocalDB{}
-	store.state.Load()
+	store, err := openStore(&cfg, cfg.Backend)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
-	s.store = &store
+	s.store = store
 	s.config = &cfg
-	s.ots = &OTSService{rpcclient: cfg.GetBitcoinRPC()}
+	s.ots = &OTSService{
+		calendars: cfg.Calendars,
+		quorum:    cfg.CalendarQuorum,
+		slack:     cfg.GetAttestationSlack(),
+		network:   cfg.GetNetwork(),
+	}
+	s.ots.headers, err = newHeaderSource(&cfg, cfg.GetHeaderSource())
+	if err != nil && cfg.Network == NETWORK_MAINNET {
+		log.Printf("%s, verifying with blockchain.info", err.Error())
+		s.ots.headers = &BlockchainInfoHeaderSource{url: DEFAULT_BLOCKCHAIN_INFO_URL}
+	} else if err != nil {
+		s.ots.headers = &MissingHeaderSource{err: err}
+	}
+	if cfg.CrossCheck != nil {
+		s.ots.cross_check, err = newHeaderSource(&cfg, cfg.CrossCheck)
+		if err != nil {
+			log.Printf("%s, not cross-checking block headers", err.Error())
+		}
+	}
+	displayFormat = cfg.Display
+	forkPolicy = cfg.ForkPolicy
+}
+
+// Takes the data directory lock. Blocks while another es process holds it.
+func (s *StreamService) Lock() {
+	lock, err := lockDataDir(s.config.DataDir)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	s.lock = lock
+}
+
+func (s *StreamService) Unlock() {
+	s.lock.Unlock()
+	s.lock = nil
+}
+
+// How often a stream is updated again when another process changed it meanwhile
+const UPDATE_ATTEMPTS = 3
+
+// Runs update on a copy of the stream without holding the data directory lock, so the relay
+// and calendar requests of a sync don't block other es processes. What update added is then
+// saved under the lock on top of the stream as it's stored by then. If its events changed in
+// the meantime, update runs again on the new ones. The stream is saved even when update fails
+// since it may have appended a few events before.
+func (s *StreamService) UpdateStream(pubkey string, update func(*EventStream) error) (*EventStream, error) {
+	for attempt := 0; attempt < UPDATE_ATTEMPTS; attempt++ {
+		s.Lock()
+		es, err := s.store.GetEventStream(pubkey)
+		s.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		before := es.eventIDs()
+		update_err := update(es)
+
+		s.Lock()
+		stored, err := s.store.GetEventStream(pubkey)
+		if err != nil {
+			s.Unlock()
+			return nil, err
+		}
+		if !sameIDs(stored.eventIDs(), before) {
+			s.Unlock()
+			continue
+		}
+		if !sameIDs(es.eventIDs(), before) || len(es.modified) > 0 {
+			stored.takeEvents(es)
+			err = s.store.SaveEventStream(stored)
+		}
+		s.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return stored, update_err
+	}
+
+	return nil, fmt.Errorf("stream %s kept changing while updating it, try again", pubkey)
+}
+
+// Follows the stream and syncs its events without holding the lock while the relays answer
+func (s *StreamService) Follow(n *Nostr, pubkey string, name string, relays []string) error {
+	s.Lock()
+	err := s.store.FollowEventStream(n, pubkey, name, relays)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	es, err := s.UpdateStream(pubkey, func(es *EventStream) error {
+		return es.Sync(n, s.ots)
+	})
+	if err != nil {
+		return err
+	}
+	es.Print(false)
+
+	return nil
+}
+
+// Picks how events of the stream get signed. Streams with a remote signer are signed
+// remotely. Otherwise a running agent that holds the key signs
+// without asking for the passphrase.
+func (s *StreamService) SignerFor(es *EventStream) Signer {
+	if es.RemoteSigner != nil {
+		return &RemoteSigner{cfg: es.RemoteSigner}
+	}
+	agent := &AgentClient{path: agentSocketPath(s.config)}
+	if agent.Has(es.SignerPubKey()) {
+		return &AgentSigner{agent: agent, pubkey: es.SignerPubKey()}
+	}
+	return &LocalSigner{es: es}
+}
+
+// Derives the private key of a child stream from the parent stream and a label
+func (s *StreamService) DeriveKey(parent_name string, label string) (string, *Derivation, error) {
+	pubkey, err := s.store.GetPubForName(parent_name)
+	if err != nil {
+		return "", nil, err
+	}
+	parent, err := s.store.GetEventStream(pubkey)
+	if err != nil {
+		return "", nil, err
+	}
+	if parent.PrivKey == "" {
+		return "", nil, fmt.Errorf("can't derive from %s, its private key is not stored here", parent_name)
+	}
+	parent_priv, err := parent.UnlockPrivKey()
+	if err != nil {
+		return "", nil, err
+	}
+	priv_key, err := deriveChildKey(parent_priv, label)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return priv_key, &Derivation{Parent: parent.PubKey, Label: label}, nil
+}
+
+// Revokes the key of an owned stream. With rotate, a new key is generated and it continues
+// the stream. The stream has to be saved even on error since events may have been appended.
+func (s *StreamService) RevokeKey(es *EventStream, reason string, rotate bool) ([]nostr.Event, error) {
+	evs := []nostr.Event{}
+	_, successor, _ := es.keyState()
+	if successor != "" && !rotate {
+		return evs, fmt.Errorf("the key of %s is being rotated, finish it with es rotate", es.Name)
+	}
+	// A successor is already named when the link of an earlier rotation failed
+	if successor == "" {
+		var next *EventStream
+		if rotate {
+			fmt.Println("Generating the successor key.")
+			next = newEventStream(es.Name, "", true, nil)
+		}
+		next_pubkey := ""
+		if next != nil {
+			next_pubkey = next.PubKey
+		}
+		ev, err := es.Revoke(reason, next_pubkey, s.SignerFor(es), s.ots)
+		if err != nil {
+			return evs, err
+		}
+		evs = append(evs, *ev)
+		if next == nil {
+			return evs, nil
+		}
+		// The successor key signs from now on
+		es.PrivKey = next.PrivKey
+		es.Derivation = next.Derivation
+		es.RemoteSigner = nil
+	}
+	ev, err := es.LinkSuccessor(s.SignerFor(es), s.ots)
+	if err != nil {
+		return evs, fmt.Errorf("can't link the successor key, run es rotate again: %w", err)
+	}
+	evs = append(evs, *ev)
+
+	return evs, nil
+}
+
+// Finds the local stream whose main chain holds the event
+func (s *StreamService) FindStreamOf(id string) (*EventStream, error) {
+	ess, err := s.store.GetAllEventStreams()
+	if err != nil {
+		return nil, err
+	}
+	for _, es := range ess {
+		for _, ev := range es.Log {
+			if ev.ID == id {
+				return es, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("event %s is not on the main chain of any local stream", id)
+}
+
+// Relays of all the streams we store. Used when a command has no stream to take them from.
+func (s *StreamService) KnownRelays() []string {
+	relays := []string{}
+	ess, err := s.store.GetAllEventStreams()
+	if err != nil {
+		return relays
+	}
+	for _, es := range ess {
+		for _, url := range es.ListRelays() {
+			if !slices.Contains(relays, url) {
+				relays = append(relays, url)
+			}
+		}
+	}
+
+	return relays
+}
+
+// The source to update the local header chain from. Without a kind it's the configured block
+// header source, or our node or the Esplora api of the network if that one doesn't serve raw
+// headers.
+func (s *StreamService) HeaderUpdateSource(kind string, location string) (RawHeaderSource, error) {
+	sc := &HeaderSourceConfig{Kind: kind, Location: location}
+	if kind == "" {
+		sc = s.config.GetHeaderSource()
+		if sc.Kind == HEADERS_SPV || sc.Kind == HEADERS_BLOCKCHAIN_INFO {
+			sc = &HeaderSourceConfig{Kind: HEADERS_ESPLORA}
+			if s.config.BTCRPC != nil {
+				sc = &HeaderSourceConfig{Kind: HEADERS_RPC}
+			}
+		}
+	}
+	if sc.Kind == HEADERS_SPV {
+		return nil, errors.New("the local header chain can't be updated from itself")
+	}
+	src, err := newHeaderSource(s.config, sc)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := src.(RawHeaderSource)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't serve raw block headers", sc.Kind)
+	}
+
+	return raw, nil
+}
+
+// Switches the storage backend and copies all the event streams to it
+func (s *StreamService) SwitchBackend(backend string) error {
+	if backend == s.config.Backend {
+		return fmt.Errorf("already using the %s backend", backend)
+	}
+	store, err := openStore(s.config, backend)
+	if err != nil {
+		return err
+	}
+	err = migrateStreams(s.store, store)
+	if err != nil {
+		return err
+	}
+	err = s.config.SetBackend(backend)
+	if err != nil {
+		return err
+	}
+	s.store = store
+
+	return nil
+}
+
+func openStore(cfg *Config, backend string) (StreamStore, error) {
+	switch backend {
+	case BACKEND_JSON:
+		store := LocalDB{}
+		store.state.Load()
+		return &store, nil
+	case BACKEND_SQLITE:
+		return NewSQLiteDB(filepath.Join(cfg.DataDir, SQLITE_FILE))
+	}
+
+	return nil, fmt.Errorf("unknown backend: %s", backend)
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Signs with the private key stored in the stream, asking for the passphrase if it's encrypted
+type LocalSigner struct {
+	es *EventStream
+}
+
+func (s *LocalSigner) Sign(ev *nostr.Event) error {
+	priv_key, err := s.es.UnlockPrivKey()
+	if err != nil {
+		return err
+	}
+	return ev.Sign(priv_key)
+}
+
+// Signs by asking the agent that holds the unlocked private key
+type AgentSigner struct {
+	agent  *AgentClient
+	pubkey string
+}
+
+func (s *AgentSigner) Sign(ev *nostr.Event) error {
+	signed, err := s.agent.Sign(s.pubkey, *ev)
+	if err != nil {
+		return err
+	}
+	// Make sure the agent signed exactly the event we asked for
+	if signed.ID != ev.GetID() {
+		return fmt.Errorf("agent signed a different event")
+	}
+	if ok, _ := signed.CheckSignature(); !ok {
+		return fmt.Errorf("agent returned an invalid signature")
+	}
+	ev.ID = signed.ID
+	ev.Sig = signed.Sig
+
+	return nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Raw headers of the local chain, in the same format the headers file source reads
+const HEADER_CHAIN_FILE = "headers.dat"
+
+// How far back an update may replace blocks of our chain
+const MAX_REORG_DEPTH = 144
+
+// Headers we keep in memory to validate new ones. A retarget needs the first header of
+// the previous period, and a reorg may take MAX_REORG_DEPTH of them away.
+const headerWindowSize = 2016 + MAX_REORG_DEPTH
+
+// Sources the header chain can be updated from. They have to serve the headers as they are,
+// not just the parts we verify attestations with.
+type RawHeaderSource interface {
+	BlockHeaderSource
+	RawHeaderAt(height uint64) (*wire.BlockHeader, error)
+	TipHeight() (uint64, error)
+}
+
+// Sources that serve many headers per request. Update fetches headers from them in batches
+// instead of one by one.
+type RawHeaderBatchSource interface {
+	// Headers from the height on, at least one and none past the tip
+	RawHeadersFrom(height uint64, tip uint64) ([]wire.BlockHeader, error)
+}
+
+// A bitcoin header chain we validated ourselves: every header links to the previous one, has
+// the difficulty the chain requires at its height and enough work for it. Verifying
+// attestations against it needs nothing but the file.
+type HeaderChain struct {
+	path    string
+	network *BitcoinNetwork
+	// Height of the first header in window
+	base   int
+	window []wire.BlockHeader
+	count  int
+}
+
+// Every network has its own chain, mainnet keeps the file name it always had
+func openHeaderChain(dir string, network *BitcoinNetwork) (*HeaderChain, error) {
+	name := HEADER_CHAIN_FILE
+	if network.Name != NETWORK_MAINNET {
+		name = fmt.Sprintf("headers-%s.dat", network.Name)
+	}
+	c := &HeaderChain{path: filepath.Join(dir, name), network: network}
+	f, err := os.Open(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// A write that didn't finish leaves part of a header at the end
+	c.count = int(info.Size() / BLOCK_HEADER_SIZE)
+	c.base = c.count - headerWindowSize
+	if c.base < 0 {
+		c.base = 0
+	}
+	if _, err = f.Seek(int64(c.base)*BLOCK_HEADER_SIZE, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	for i := c.base; i < c.count; i++ {
+		var h wire.BlockHeader
+		if err = h.Deserialize(r); err != nil {
+			return nil, fmt.Errorf("can't read header %d of %s: %v", i, c.path, err)
+		}
+		c.window = append(c.window, h)
+	}
+
+	return c, nil
+}
+
+// Height of the tip, -1 while the chain is empty
+func (c *HeaderChain) Height() int {
+	return c.count - 1
+}
+
+func (c *HeaderChain) Tip() *wire.BlockHeader {
+	if len(c.window) == 0 {
+		return nil
+	}
+	return &c.window[len(c.window)-1]
+}
+
+func (c *HeaderChain) Name() string {
+	return "local header chain"
+}
+
+func (c *HeaderChain) IsRemote() bool {
+	return false
+}
+
+func (c *HeaderChain) HeaderAt(height uint64) (*BlockHeader, error) {
+	if int(height) > c.Height() {
+		return nil, fmt.Errorf("block %d is past the tip %d of the local header chain, update it with es headers update", height, c.Height())
+	}
+	h, err := c.rawHeaderAt(int(height))
+	if err != nil {
+		return nil, err
+	}
+	return &BlockHeader{Height: height, Hash: h.BlockHash().String(), MerkleRoot: h.MerkleRoot.String(), Time: h.Timestamp}, nil
+}
+
+func (c *HeaderChain) rawHeaderAt(height int) (*wire.BlockHeader, error) {
+	if height >= c.base && height < c.count {
+		return &c.window[height-c.base], nil
+	}
+	src := &HeadersFileSource{path: c.path}
+	return src.RawHeaderAt(uint64(height))
+}
+
+// Replaces the chain with the headers in the file. The file has to start at the genesis block
+// and have more work than the chain we have.
+func (c *HeaderChain) Import(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	our_work, err := c.work(0)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := &HeaderChain{path: c.path, network: c.network}
+	err = writeFileAtomic(c.path, 0600, func(w io.Writer) error {
+		r := bufio.NewReader(f)
+		work := new(big.Int)
+		for {
+			var h wire.BlockHeader
+			err := h.Deserialize(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("can't read header %d of %s: %v", imported.count, path, err)
+			}
+			if err = imported.connect(h); err != nil {
+				return err
+			}
+			if err = h.Serialize(w); err != nil {
+				return err
+			}
+			work.Add(work, blockchain.CalcWork(h.Bits))
+		}
+		if work.Cmp(our_work) <= 0 {
+			return fmt.Errorf("the headers in %s don't have more work than the local chain", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	*c = *imported
+
+	return c.count, nil
+}
+
+// Extends the chain with the headers the source has past our tip. If the source is on another
+// branch, our blocks since the fork are replaced as long as its branch has more work.
+// Returns how many headers were added.
+func (c *HeaderChain) Update(src RawHeaderSource) (int, error) {
+	tip, err := src.TipHeight()
+	if err != nil {
+		return 0, fmt.Errorf("can't get the tip of %s: %v", src.Name(), err)
+	}
+	// Find the last block we agree on
+	fork := c.Height()
+	if fork > int(tip) {
+		fork = int(tip)
+	}
+	for ; fork >= 0; fork-- {
+		if c.Height()-fork > MAX_REORG_DEPTH {
+			return 0, fmt.Errorf("%s forks off the local chain more than %d blocks back", src.Name(), MAX_REORG_DEPTH)
+		}
+		theirs, err := src.RawHeaderAt(uint64(fork))
+		if err != nil {
+			return 0, err
+		}
+		if theirs.BlockHash() == c.window[fork-c.base].BlockHash() {
+			break
+		}
+	}
+
+	next := &HeaderChain{path: c.path, network: c.network, base: c.base, count: fork + 1}
+	next.window = append([]wire.BlockHeader{}, c.window[:fork+1-c.base]...)
+	added := []wire.BlockHeader{}
+	new_work := new(big.Int)
+	for height := fork + 1; height <= int(tip); {
+		headers, err := rawHeadersFrom(src, uint64(height), tip)
+		if err != nil {
+			return 0, err
+		}
+		for _, h := range headers {
+			if err = next.connect(h); err != nil {
+				return 0, fmt.Errorf("invalid header %d from %s: %v", height, src.Name(), err)
+			}
+			added = append(added, h)
+			new_work.Add(new_work, blockchain.CalcWork(h.Bits))
+			height++
+		}
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+	if fork < c.Height() {
+		old_work, err := c.work(fork + 1)
+		if err != nil {
+			return 0, err
+		}
+		if new_work.Cmp(old_work) <= 0 {
+			return 0, fmt.Errorf("the branch of %s doesn't have more work than the local chain", src.Name())
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	for _, h := range added {
+		h.Serialize(buf)
+	}
+	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err = f.Truncate(int64(fork+1) * BLOCK_HEADER_SIZE); err != nil {
+		return 0, err
+	}
+	if _, err = f.WriteAt(buf.Bytes(), int64(fork+1)*BLOCK_HEADER_SIZE); err != nil {
+		return 0, err
+	}
+	if err = f.Sync(); err != nil {
+		return 0, err
+	}
+	*c = *next
+
+	return len(added), nil
+}
+
+// The next headers from the source, a batch of them if it serves batches
+func rawHeadersFrom(src RawHeaderSource, height uint64, tip uint64) ([]wire.BlockHeader, error) {
+	if batch_src, ok := src.(RawHeaderBatchSource); ok {
+		headers, err := batch_src.RawHeadersFrom(height, tip)
+		if err != nil {
+			return nil, err
+		}
+		if len(headers) == 0 {
+			return nil, fmt.Errorf("%s returned no headers from block %d", src.Name(), height)
+		}
+		return headers, nil
+	}
+	h, err := src.RawHeaderAt(height)
+	if err != nil {
+		return nil, err
+	}
+	return []wire.BlockHeader{*h}, nil
+}
+
+// Validates the header and makes it the new tip
+func (c *HeaderChain) connect(h wire.BlockHeader) error {
+	height := c.count
+	hash := h.BlockHash()
+	if height == 0 {
+		if hash != *c.network.params.GenesisHash {
+			return fmt.Errorf("the first header %s is not the genesis block of %s", hash, c.network.params.Name)
+		}
+	} else {
+		prev := c.Tip()
+		if h.PrevBlock != prev.BlockHash() {
+			return fmt.Errorf("header %d doesn't build on %s", height, prev.BlockHash())
+		}
+		bits, err := c.requiredBits(height, &h)
+		if err != nil {
+			return err
+		}
+		if h.Bits != bits {
+			return fmt.Errorf("header %d has difficulty bits %08x, expected %08x", height, h.Bits, bits)
+		}
+		if !h.Timestamp.After(c.medianTimePast()) {
+			return fmt.Errorf("header %d has time %s, not after the median of the previous blocks", height, h.Timestamp.UTC())
+		}
+	}
+	target := blockchain.CompactToBig(h.Bits)
+	if target.Sign() <= 0 || target.Cmp(c.network.params.PowLimit) > 0 {
+		return fmt.Errorf("header %d has an invalid target %08x", height, h.Bits)
+	}
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return fmt.Errorf("header %d doesn't have enough proof of work", height)
+	}
+
+	c.window = append(c.window, h)
+	c.count++
+	if len(c.window) > headerWindowSize {
+		c.window = c.window[len(c.window)-headerWindowSize:]
+		c.base = c.count - headerWindowSize
+	}
+	return nil
+}
+
+// The difficulty the header at height must have
+func (c *HeaderChain) requiredBits(height int, h *wire.BlockHeader) (uint32, error) {
+	prev := c.Tip()
+	blocks_per_retarget := int(c.network.params.TargetTimespan / c.network.params.TargetTimePerBlock)
+	if height%blocks_per_retarget != 0 {
+		if !c.network.params.ReduceMinDifficulty {
+			return prev.Bits, nil
+		}
+		return c.minDifficultyBits(height, h, blocks_per_retarget)
+	}
+	if c.network.no_retargeting {
+		return prev.Bits, nil
+	}
+	first, err := c.rawHeaderAt(height - blocks_per_retarget)
+	if err != nil {
+		return 0, err
+	}
+	timespan := int64(prev.Timestamp.Sub(first.Timestamp) / time.Second)
+	target_timespan := int64(c.network.params.TargetTimespan / time.Second)
+	min_timespan := target_timespan / c.network.params.RetargetAdjustmentFactor
+	max_timespan := target_timespan * c.network.params.RetargetAdjustmentFactor
+	if timespan < min_timespan {
+		timespan = min_timespan
+	} else if timespan > max_timespan {
+		timespan = max_timespan
+	}
+	target := blockchain.CompactToBig(prev.Bits)
+	target.Mul(target, big.NewInt(timespan))
+	target.Div(target, big.NewInt(target_timespan))
+	if target.Cmp(c.network.params.PowLimit) > 0 {
+		target.Set(c.network.params.PowLimit)
+	}
+
+	return blockchain.BigToCompact(target), nil
+}
+
+// Testnet allows a block with the lowest difficulty when no block was found for twice the
+// block time. Otherwise it's the difficulty of the last block that didn't use the rule.
+func (c *HeaderChain) minDifficultyBits(height int, h *wire.BlockHeader, blocks_per_retarget int) (uint32, error) {
+	limit_bits := c.network.params.PowLimitBits
+	prev := c.Tip()
+	if h.Timestamp.After(prev.Timestamp.Add(c.network.params.MinDiffReductionTime)) {
+		return limit_bits, nil
+	}
+	for i := height - 1; i%blocks_per_retarget != 0; i-- {
+		header, err := c.rawHeaderAt(i)
+		if err != nil {
+			return 0, err
+		}
+		if header.Bits != limit_bits {
+			return header.Bits, nil
+		}
+	}
+	first, err := c.rawHeaderAt(height - height%blocks_per_retarget)
+	if err != nil {
+		return 0, err
+	}
+	return first.Bits, nil
+}
+
+// Median time of the last 11 blocks
+func (c *HeaderChain) medianTimePast() time.Time {
+	times := []time.Time{}
+	for i := len(c.window) - 1; i >= 0 && len(times) < 11; i-- {
+		times = append(times, c.window[i].Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times[len(times)/2]
+}
+
+// Total work of the blocks from the height to the tip
+func (c *HeaderChain) work(from int) (*big.Int, error) {
+	work := new(big.Int)
+	if c.count == 0 {
+		return work, nil
+	}
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(int64(from)*BLOCK_HEADER_SIZE, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	for i := from; i < c.count; i++ {
+		var h wire.BlockHeader
+		if err = h.Deserialize(r); err != nil {
+			return nil, err
+		}
+		work.Add(work, blockchain.CalcWork(h.Bits))
+	}
+	return work, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Blocks 0 to 3 of mainnet
+var mainnetHeaders = []string{
+	"0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c",
+	"010000006fe28c0ab6f1b372c1a6a246ae63f74f931e8365e15a089c68d6190000000000982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e61bc6649ffff001d01e36299",
+	"010000004860eb18bf1b1620e37e9490fc8a427514416fd75159ab86688e9a8300000000d5fdcc541e25de1c7a5addedf24858b8bb665c9f36ef744ee42c316022c90f9bb0bc6649ffff001d08d2bd61",
+	"01000000bddd99ccfda39da1b108ce1a5d70038d0a967bacb68b6b63065f626a0000000044f672226090d85db9a9f2fbfe5f0f9609b387af7be5b7fbb7a1767c831c9e995dbe6649ffff001d05e0ed6d",
+}
+
+// Blocks 0 to 2 of testnet3
+var testnetHeaders = []string{
+	"0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4adae5494dffff001d1aa4ae18",
+	"0100000043497fd7f826957108f4a30fd9cec3aeba79972084e90ead01ea330900000000bac8b0fa927c0ac8234287e33c5f74d38d354820e24756ad709d7038fc5f31f020e7494dffff001d03e4b672",
+	"0100000006128e87be8b1b4dea47a7247d5528d2702c96826c7a648497e773b800000000e241352e3bec0a95a6217e10c3abb54adfa05abb12c126695595580fb92e222032e7494dffff001d00d23534",
+}
+
+func parseHeaders(t *testing.T, hexes []string) []wire.BlockHeader {
+	headers := []wire.BlockHeader{}
+	for _, s := range hexes {
+		raw, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h wire.BlockHeader
+		if err = h.Deserialize(bytes.NewReader(raw)); err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, h)
+	}
+	return headers
+}
+
+// Mines n regtest headers on top of the chain, regtest difficulty takes a few tries per block.
+// Blocks mined with another version make another branch.
+func mineRegtest(chain []wire.BlockHeader, n int, version int32) []wire.BlockHeader {
+	target := blockchain.CompactToBig(networks[NETWORK_REGTEST].params.PowLimitBits)
+	for i := 0; i < n; i++ {
+		prev := chain[len(chain)-1]
+		h := wire.BlockHeader{
+			Version:   version,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Timestamp.Add(10 * time.Minute),
+			Bits:      prev.Bits,
+		}
+		for {
+			hash := h.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+			h.Nonce++
+		}
+		chain = append(chain, h)
+	}
+	return chain
+}
+
+func regtestChain(n int) []wire.BlockHeader {
+	genesis := networks[NETWORK_REGTEST].params.GenesisBlock.Header
+	return mineRegtest([]wire.BlockHeader{genesis}, n, 4)
+}
+
+func TestHeaderChainConnect(t *testing.T) {
+	mainnet := parseHeaders(t, mainnetHeaders)
+	testnet := parseHeaders(t, testnetHeaders)
+	regtest := regtestChain(20)
+
+	tampered := mainnet[2]
+	tampered.Nonce++
+	easier := mainnet[1]
+	easier.Bits = 0x1d01ffff
+	early := regtest[5]
+	early.Timestamp = regtest[0].Timestamp
+
+	tests := []struct {
+		name    string
+		network string
+		headers []wire.BlockHeader
+		err     string
+	}{
+		{"mainnet", NETWORK_MAINNET, mainnet, ""},
+		{"testnet", NETWORK_TESTNET, testnet, ""},
+		{"regtest", NETWORK_REGTEST, regtest, ""},
+		{"testnet genesis on mainnet", NETWORK_MAINNET, testnet, "is not the genesis block"},
+		{"mainnet on regtest", NETWORK_REGTEST, mainnet, "is not the genesis block"},
+		{"missing block", NETWORK_MAINNET, []wire.BlockHeader{mainnet[0], mainnet[2]}, "doesn't build on"},
+		{"tampered nonce", NETWORK_MAINNET, []wire.BlockHeader{mainnet[0], mainnet[1], tampered}, "enough proof of work"},
+		{"wrong difficulty", NETWORK_MAINNET, []wire.BlockHeader{mainnet[0], easier}, "difficulty bits"},
+		{"time before median", NETWORK_REGTEST, append(append([]wire.BlockHeader{}, regtest[:5]...), early), "median"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := openHeaderChain(t.TempDir(), networks[tt.network])
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, h := range tt.headers {
+				if err = c.connect(h); err != nil {
+					break
+				}
+			}
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("connect failed: %v", err)
+				}
+				if c.Height() != len(tt.headers)-1 || c.Tip().BlockHash() != tt.headers[len(tt.headers)-1].BlockHash() {
+					t.Fatalf("tip is %d %s", c.Height(), c.Tip().BlockHash())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// Serves the headers the way an Esplora api does and counts the requests
+func esploraStandIn(chain *[]wire.BlockHeader, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		headers := *chain
+		path := strings.Trim(r.URL.Path, "/")
+		parts := strings.Split(path, "/")
+		switch {
+		case path == "blocks/tip/height":
+			fmt.Fprint(w, len(headers)-1)
+		case len(parts) == 2 && parts[0] == "blocks":
+			last, _ := strconv.Atoi(parts[1])
+			blocks := []esploraBlock{}
+			for height := last; height >= 0 && height > last-ESPLORA_BLOCKS_PER_PAGE; height-- {
+				h := headers[height]
+				block := esploraBlock{
+					ID:         h.BlockHash().String(),
+					Height:     uint64(height),
+					MerkleRoot: h.MerkleRoot.String(),
+					Timestamp:  h.Timestamp.Unix(),
+					Version:    h.Version,
+					Bits:       h.Bits,
+					Nonce:      h.Nonce,
+				}
+				if height > 0 {
+					block.Prev = h.PrevBlock.String()
+				}
+				blocks = append(blocks, block)
+			}
+			json.NewEncoder(w).Encode(blocks)
+		case len(parts) == 2 && parts[0] == "block-height":
+			height, _ := strconv.Atoi(parts[1])
+			fmt.Fprint(w, headers[height].BlockHash().String())
+		case len(parts) == 3 && parts[0] == "block" && parts[2] == "header":
+			for _, h := range headers {
+				if h.BlockHash().String() == parts[1] {
+					buf := new(bytes.Buffer)
+					h.Serialize(buf)
+					fmt.Fprint(w, hex.EncodeToString(buf.Bytes()))
+					return
+				}
+			}
+			http.NotFound(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestHeaderChainUpdateFromEsplora(t *testing.T) {
+	served := regtestChain(24)
+	var requests int32
+	srv := esploraStandIn(&served, &requests)
+	defer srv.Close()
+	src := &EsploraHeaderSource{url: srv.URL}
+
+	dir := t.TempDir()
+	c, err := openHeaderChain(dir, networks[NETWORK_REGTEST])
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := c.Update(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tip height and three pages of blocks
+	if added != 25 || requests != 4 {
+		t.Fatalf("added %d headers with %d requests", added, requests)
+	}
+
+	// Extend the served chain, the update only fetches the new blocks
+	served = mineRegtest(served, 3, 4)
+	if added, err = c.Update(src); err != nil || added != 3 {
+		t.Fatalf("added %d headers: %v", added, err)
+	}
+
+	// A branch with more work replaces our last blocks
+	served = mineRegtest(append([]wire.BlockHeader{}, served[:26]...), 5, 5)
+	if added, err = c.Update(src); err != nil || added != 5 {
+		t.Fatalf("added %d headers on the new branch: %v", added, err)
+	}
+
+	// The file has the chain we were served
+	reopened, err := openHeaderChain(dir, networks[NETWORK_REGTEST])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Height() != len(served)-1 || reopened.Tip().BlockHash() != served[len(served)-1].BlockHash() {
+		t.Fatalf("reopened chain is at %d %s", reopened.Height(), reopened.Tip().BlockHash())
+	}
+}
+
+func TestEsploraBlockHeaderMustMatchID(t *testing.T) {
+	h := parseHeaders(t, mainnetHeaders)[1]
+	block := esploraBlock{
+		ID:         h.BlockHash().String(),
+		MerkleRoot: h.MerkleRoot.String(),
+		Prev:       h.PrevBlock.String(),
+		Timestamp:  h.Timestamp.Unix(),
+		Version:    h.Version,
+		Bits:       h.Bits,
+		Nonce:      h.Nonce,
+	}
+	if rebuilt, err := block.header(); err != nil || rebuilt.BlockHash() != h.BlockHash() {
+		t.Fatalf("can't rebuild the header: %v", err)
+	}
+	block.Nonce++
+	if _, err := block.header(); err == nil {
+		t.Fatal("a header that doesn't hash to the block id was accepted")
+	}
+}
@@ -24,27 +24,40 @@ type EventStream struct {
 	PubKey  string        `json:"pubkey"`
 	Relays  []string      `json:"relays"`
 	Log     []nostr.Event `json:"log"`
+	// Events of branches that fork off the main chain in Log
+	Side []nostr.Event `json:"side,omitempty"`
+	// Set when the private key lives on a remote signer
+	RemoteSigner *RemoteSignerConfig `json:"remote_signer,omitempty"`
+	// Clients of our remote signer present it to connect
+	BunkerSecret string `json:"bunker_secret,omitempty"`
+	// Set when the private key was derived from seed words or a parent stream
+	Derivation *Derivation `json:"derivation,omitempty"`
+	// Proofs that the author published conflicting events
+	Forks []ForkProof `json:"forks,omitempty"`
+	// Events found out of order once their attestation or one before them completed, by id
+	OutOfOrder map[string]string `json:"out_of_order,omitempty"`
+	// Merkle Mountain Range over the main chain
+	MMR *MMR `json:"mmr,omitempty"`
+	// Ids of main chain events that changed since the stream was loaded, e.g. their attestation
+	// got upgraded. The store has to write them again.
+	modified map[string]bool
+	// Set when the stream was loaded without its events. Size, head and MMR come from where the
+	// event log was saved and only the metadata can be changed and saved.
+	unloaded *Checkpoint
 }
 
-func (es *EventStream) Create(content string, ots Timestamper) (*nostr.Event, error) {
-	if es.PrivKey == "" {
-		return nil, fmt.Errorf("can't create an event. No private key for this stream is set")
-	}
-	prev := es.GetHead()
-	tags := nostr.Tags{nostr.Tag{"prev", prev}}
+func (es *EventStream) Create(content string, signer Signer, ots Timestamper) (*nostr.Event, error) {
+	return es.createEvent(nostr.KindTextNote, content, nostr.Tags{}, signer, ots)
+}
 
-	event := &nostr.Event{
-		CreatedAt: time.Now(),
-		Kind:      nostr.KindTextNote,
-		Tags:      tags,
-		Content:   content,
-		PubKey:    es.PubKey,
+// Creates, signs, stamps and appends an event of the given kind to the stream
+func (es *EventStream) createEvent(kind int, content string, extra_tags nostr.Tags, signer Signer, ots Timestamper) (*nostr.Event, error) {
+	if err := es.checkCanCreate(); err != nil {
+		return nil, err
 	}
-
-	// Sign the event
-	err := event.Sign(es.PrivKey)
+	event, err := es.newEvent(kind, content, extra_tags, es.GetHead(), signer)
 	if err != nil {
-		return nil, fmt.Errorf("error signing event: %w", err)
+		return nil, err
 	}
 
 	// Stamp with ots
@@ -63,10 +76,91 @@ func (es *EventStream) Create(content string, ots Timestamper) (*nostr.Event, er
 	return event, nil
 }
 
+// Creates a text note for every content, each building on the one before, and stamps them
+// all with a single batch. Returns the events that were appended, which are all of them
+// unless there's an error.
+func (es *EventStream) CreateBatch(contents []string, signer Signer, ots Timestamper) ([]*nostr.Event, error) {
+	if err := es.checkCanCreate(); err != nil {
+		return nil, err
+	}
+	events := []*nostr.Event{}
+	prev := es.GetHead()
+	for _, content := range contents {
+		event, err := es.newEvent(nostr.KindTextNote, content, nostr.Tags{}, prev, signer)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		prev = event.ID
+	}
+
+	stamps, err := ots.StampBatch(events)
+	if err != nil {
+		return nil, fmt.Errorf("Event stamping error: %v", err)
+	}
+	for i, event := range events {
+		event.SetExtra("ots", stamps[i])
+		if err = es.Append(*event, ots); err != nil {
+			return events[:i], err
+		}
+	}
+
+	return events, nil
+}
+
+func (es *EventStream) checkCanCreate() error {
+	if !es.IsOwned() {
+		return fmt.Errorf("can't create an event. No private key or remote signer for this stream is set")
+	}
+	if es.IsRevoked() {
+		return fmt.Errorf("can't create an event. The key of %s was revoked", es.Name)
+	}
+	if es.IsFrozen() {
+		return fmt.Errorf("can't create an event. %s is frozen because of a fork", es.Name)
+	}
+	return nil
+}
+
+// Builds and signs an event that builds on prev
+func (es *EventStream) newEvent(kind int, content string, extra_tags nostr.Tags, prev string, signer Signer) (*nostr.Event, error) {
+	tags := append(nostr.Tags{nostr.Tag{"prev", prev}}, extra_tags...)
+	event := &nostr.Event{
+		CreatedAt: time.Now(),
+		Kind:      kind,
+		Tags:      tags,
+		Content:   content,
+		PubKey:    es.SignerPubKey(),
+	}
+
+	// Sign the event
+	err := signer.Sign(event)
+	if err != nil {
+		return nil, fmt.Errorf("error signing event: %w", err)
+	}
+	return event, nil
+}
+
+// Adds the event to the stream. An event that builds on the head extends the main chain,
+// one that builds on any other event of the stream forks it and goes to a side branch.
 func (es *EventStream) Append(ev nostr.Event, ots Timestamper) error {
-	// Check pubkey and verify signature
-	if ev.PubKey != es.PubKey {
-		return fmt.Errorf("can't append event from pubkey %s to stream with pubkey %s", ev.PubKey, es.PubKey)
+	if es.unloaded != nil {
+		return fmt.Errorf("%s was loaded without its events", es.Name)
+	}
+	if es.HasEvent(ev.ID) {
+		return fmt.Errorf("event %s is already in the stream", ev.ID)
+	}
+	if es.IsFrozen() {
+		return fmt.Errorf("%s is frozen because of a fork. See es forks %s", es.Name, es.Name)
+	}
+	// The chain the event builds on, either the main chain or a side branch
+	prev := get_prev(ev)
+	chain, err := es.chainTo(prev)
+	if err != nil {
+		return err
+	}
+	// Check pubkey, including key rotations, and verify signature
+	if err := es.checkKeyRules(chain, ev); err != nil {
+		return err
 	}
 	ok, err := ev.CheckSignature()
 	if err != nil {
@@ -77,69 +171,83 @@ func (es *EventStream) Append(ev nostr.Event, ots Timestamper) error {
 		// According to code, if the signature is not valid 'ok' will be false
 		return fmt.Errorf("signature verification failed for event: %s", ev.ID)
 	}
-	if es.Size() > 0 {
-		// Verify "prev" of the new event matches the last event id
-		last_event_id := es.Log[len(es.Log)-1].ID
-		prev := get_prev(ev)
-		if prev != last_event_id {
-			return fmt.Errorf("reference to previous event mismatch. Last event id: %s, prev: %s", last_event_id, prev)
-		}
-	}
 
 	// Verifying "ots" before appending gives us a guarantee that every stream will have attestations
-	// Additonally, we check if the attestation is linear in case we get attested time.
+	// Additonally, we check the attested time follows the chain in case we get attested time.
 	if ev.GetExtraString("ots") == "" {
 		return fmt.Errorf("event is missing the \"ots\" field")
 	}
 	is_good, attested_time, err := ots.Verify(&ev)
 	if !is_good {
 		return err
-	} else {
-		if attested_time != nil {
-			// Check that it builds on the previous event
-			last_event := es.Log[len(es.Log)-1]
-			// TODO: We should check attestation time, not event.created_at field
-			if attested_time.Before(last_event.CreatedAt) {
-				return fmt.Errorf("attested time is after the last event created at")
-			}
+	}
+	if attested_time != nil {
+		order := newAttestationOrder(ots.AttestationSlack())
+		order.resume(chain, ots)
+		if err := order.Check(&ev, attested_time); err != nil {
+			return err
 		}
 	}
 
-	// Append event to the stream
-	es.Log = append(es.Log, ev)
+	if prev == es.GetHead() {
+		// Append event to the stream and its MMR
+		m := es.mmr()
+		es.Log = append(es.Log, ev)
+		return m.Append(ev.ID)
+	}
+	es.addBranchEvent(ev, ots)
 
 	return nil
 }
 
-// Sync a stream - find the latest HEAD and query for the next event of the stream and repeat
+// Sync a stream - find the events that build on the events we have and append them
 func (es *EventStream) Sync(n *Nostr, ots Timestamper) error {
 	fmt.Printf("Syncing %s ... ", es.Name)
-	prev := es.GetHead()
 	num_new := 0
-	// Start from the genesis event and iterate forward
-	for {
-		events, err := findNextEvents(n, es.PubKey, prev)
+	// After a key rotation the events are signed by the successor key, so we query again
+	// until the key stops changing
+	queried := map[string]bool{}
+	for !es.IsRevoked() && !queried[es.SignerPubKey()] {
+		pubkey := es.SignerPubKey()
+		queried[pubkey] = true
+		events, err := findNextEvents(n, pubkey, es.eventIDs())
 		if err != nil {
 			fmt.Println(err.Error())
 			break
 		}
-		if len(events) == 0 {
-			break
-		}
-		num_new += len(events)
+		skipped := map[string]bool{}
 		for _, ev := range events {
+			// Whatever a revoked key signed after the revocation is not part of the stream
+			if skipped[get_prev(*ev)] || !es.allowsSigner(*ev) {
+				skipped[ev.ID] = true
+				continue
+			}
+			forks := len(es.Forks)
 			err = es.Append(*ev, ots)
 			if err != nil {
 				return err
 			}
-			prev = ev.ID
+			num_new++
+			if len(es.Forks) > forks {
+				fmt.Printf("\nFound a fork in %s at %s. See es forks %s.\n", es.Name, showEventID(get_prev(*ev)), es.Name)
+			}
 		}
 	}
-	fmt.Printf("Done\nNumber of new events: %d\nHEAD (%s) at: %s", num_new, es.Name, es.GetHead())
+	fmt.Printf("Done\nNumber of new events: %d\nHEAD (%s) at: %s", num_new, es.Name, showEventID(es.GetHead()))
 
 	return nil
 }
 
+// Whether the key rules allow the author to sign on top of the event's prev
+func (es *EventStream) allowsSigner(ev nostr.Event) bool {
+	chain, err := es.chainTo(get_prev(ev))
+	if err != nil {
+		// Append reports it
+		return true
+	}
+	return es.checkKeyRules(chain, ev) == nil
+}
+
 // Publishes the whole event stream to the given relay
 func (es *EventStream) Mirror(n *Nostr, relayUrl string) error {
 	// Ensure the relayUrl is on the pool of relays
@@ -166,32 +274,71 @@ func (es *EventStream) Mirror(n *Nostr, relayUrl string) error {
 	return nil
 }
 
+// Returns the hex private key of the stream, asking for the passphrase if the key is encrypted
+func (es *EventStream) UnlockPrivKey() (string, error) {
+	if !es.IsEncrypted() {
+		return es.PrivKey, nil
+	}
+	passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", es.Name), false)
+	if err != nil {
+		return "", err
+	}
+	priv_key, err := decryptPrivKey(es.PrivKey, passphrase)
+	if err != nil {
+		return "", err
+	}
+	if getPubKey(priv_key) != es.SignerPubKey() {
+		return "", fmt.Errorf("decrypted key doesn't match the pubkey of %s", es.Name)
+	}
+
+	return priv_key, nil
+}
+
+// We own a stream if we can sign its events, either with a local key or a remote signer
+func (es *EventStream) IsOwned() bool {
+	return es.PrivKey != "" || es.RemoteSigner != nil
+}
+
+func (es *EventStream) IsEncrypted() bool {
+	return isEncryptedKey(es.PrivKey)
+}
+
+// Encrypts the plaintext private key of the stream with the passphrase
+func (es *EventStream) EncryptPrivKey(passphrase string) error {
+	if es.PrivKey == "" {
+		return fmt.Errorf("%s has no private key, we merely follow it", es.Name)
+	}
+	if es.IsEncrypted() {
+		return fmt.Errorf("the private key of %s is already encrypted", es.Name)
+	}
+	if passphrase == "" {
+		return errors.New("passphrase can't be empty")
+	}
+	encrypted, err := encryptPrivKey(es.PrivKey, passphrase)
+	if err != nil {
+		return err
+	}
+	es.PrivKey = encrypted
+
+	return nil
+}
+
 func (es *EventStream) Size() int {
+	if es.unloaded != nil {
+		return es.unloaded.Size
+	}
 	return len(es.Log)
 }
 
-// Computes the HEAD from the log
+// The head of the main chain. Append keeps the main chain linear, forks go to side branches.
 func (es *EventStream) GetHead() string {
-	prev_to_id := make(map[string]string)
-
-	for _, event := range es.Log {
-		for _, tag := range event.Tags {
-			if tag.Key() == "prev" {
-				// TODO: check if we already had this "prev"
-				prev_to_id[tag.Value()] = event.ID
-			}
-		}
+	if es.unloaded != nil {
+		return es.unloaded.Head
 	}
-
-	prev := GENESIS
-	for {
-		next, found := prev_to_id[prev]
-		if !found {
-			return prev
-		} else {
-			prev = next
-		}
+	if len(es.Log) == 0 {
+		return GENESIS
 	}
+	return es.Log[len(es.Log)-1].ID
 }
 
 func (es *EventStream) AddRelay(url string) error {
@@ -233,11 +380,22 @@ func (es *EventStream) HasRelays() bool {
 }
 
 func (es *EventStream) Print(show_chain bool) {
-	fmt.Printf("%s (%s)\n", es.Name, es.PubKey)
+	fmt.Printf("%s (%s)", es.Name, showPubKey(es.PubKey))
+	if es.IsRevoked() {
+		fmt.Printf(" revoked")
+	} else if es.IsFrozen() {
+		fmt.Printf(" frozen")
+	} else if es.SignerPubKey() != es.PubKey {
+		fmt.Printf(" signed by %s", showPubKey(es.SignerPubKey()))
+	}
+	fmt.Println()
 	if !show_chain {
 		return
 	}
 	indent := "\t\t\t"
+	if es.Size() > 0 {
+		fmt.Printf("HEAD: %s\nMMR root: %s\n", showEventID(es.GetHead()), es.MMRRoot())
+	}
 	fmt.Printf("\nEvent stream:\n")
 	fmt.Printf("----------------------------------------------------------\n")
 	fmt.Printf("%s%s", indent, GENESIS)
@@ -257,55 +415,128 @@ func (es *EventStream) Print(show_chain bool) {
 			fmt.Printf("\n%sv\n", indent)
 		}
 	}
+
+	for _, branch := range es.Branches() {
+		fmt.Printf("\nSide branch forking off %s:\n", showEventID(get_prev(branch[0])))
+		for _, event := range branch {
+			fmt.Printf("----------------------------------------------------------\n")
+			printEvent(event, &es.Name, true)
+			fmt.Printf("\n----------------------------------------------------------\n")
+		}
+	}
 }
 
-func (es *EventStream) OTSUpgrade() error {
-	return errors.New("not implemented")
+// Upgrades the pending attestations of the stream. The upgraded proofs are kept in the events,
+// so verifying them later doesn't need the calendar. Attestations that complete out of order
+// are printed but stay, see recheckAttestationOrder. Returns how many attestations got
+// complete and how many are still pending.
+func (es *EventStream) OTSUpgrade(ots Timestamper) (int, int) {
+	num_upgraded, num_pending := 0, 0
+	for _, ev := range es.pendingAttestations(ots) {
+		before := ev.GetExtraString("ots")
+		_, err := ots.Upgrade(ev)
+		if ev.GetExtraString("ots") != before {
+			es.markModified(ev.ID)
+		}
+		if err != nil {
+			if err != ErrOTSPending && err != ErrOTSWaitingConfirmations {
+				fmt.Printf("\nEvent id: %s: %s", ev.ID, err.Error())
+			}
+			num_pending++
+			continue
+		}
+		num_upgraded++
+		if err := es.recheckAttestationOrder(ev, ots); err != nil {
+			fmt.Printf("\nEvent id: %s: %s", ev.ID, err.Error())
+		}
+	}
+
+	return num_upgraded, num_pending
 }
 
-// Verifies two things:
-// 1. Every event must have an attestation
-// 2. Events must have linear attested time
-func (es *EventStream) OTSVerify(ots Timestamper) {
-	last_attestation_time := time.Time{}
-	last_attestation_event_id := "/"
-	for _, ev := range es.Log {
-		is_good, attested_time, err := ots.Verify(&ev)
-		printOTSResult(&ev, is_good, attested_time, err)
-		if attested_time != nil {
-			if attested_time.Before(last_attestation_time) {
-				fmt.Printf("\nError: Nonlinear attestations found.")
-				fmt.Printf("\nLast event id: %s", last_attestation_event_id)
-				fmt.Printf("Event id: %s", ev.ID)
-			} else {
-				last_attestation_time = *attested_time
-				last_attestation_event_id = ev.ID
+// Takes the events of a copy of the stream that has more of them. Attestations that got
+// upgraded in the stored stream while the copy was away are kept.
+func (es *EventStream) takeEvents(other *EventStream) {
+	upgraded := map[string]string{}
+	for _, chain := range [][]nostr.Event{es.Log, es.Side} {
+		for _, ev := range chain {
+			if info, err := inspectOTS(&ev); err == nil && info.IsComplete() {
+				upgraded[ev.ID] = ev.GetExtraString("ots")
 			}
 		}
 	}
-	if !ots.HasRPCConfigured() {
-		fmt.Println("\nNOTE: In case you don't trust blockchain.info, verify the merkle root hashes manually.")
+	es.Log, es.Side, es.Forks, es.MMR = other.Log, other.Side, other.Forks, other.MMR
+	es.modified = other.modified
+	for id, msg := range other.OutOfOrder {
+		if es.OutOfOrder == nil {
+			es.OutOfOrder = map[string]string{}
+		}
+		es.OutOfOrder[id] = msg
+	}
+	for i := range es.Log {
+		if ots, ok := upgraded[es.Log[i].ID]; ok && ots != es.Log[i].GetExtraString("ots") {
+			es.Log[i].SetExtra("ots", ots)
+			es.markModified(es.Log[i].ID)
+		}
+	}
+	for i := range es.Side {
+		if ots, ok := upgraded[es.Side[i].ID]; ok {
+			es.Side[i].SetExtra("ots", ots)
+		}
 	}
 }
 
-func printOTSResult(ev *nostr.Event, is_good bool, attested_time *time.Time, err error) {
-	status := "FAIL"
-	if is_good {
-		status = "OK"
+// The main chain events before the given position that changed since the stream was loaded
+func (es *EventStream) modifiedEvents(before int) []nostr.Event {
+	evs := []nostr.Event{}
+	for i := 0; i < before && len(evs) < len(es.modified); i++ {
+		if es.modified[es.Log[i].ID] {
+			evs = append(evs, es.Log[i])
+		}
 	}
-	if err != nil {
-		if err == ErrOTSPending {
-			fmt.Printf("\nEvent id: %s: Status: %s (PENDING)", ev.ID, status)
-		} else if err == ErrOTSWaitingConfirmations {
-			fmt.Printf("\nEvent id: %s: Status: %s (WAITING 5 CONFIRMATIONS)", ev.ID, status)
-		} else {
-			fmt.Printf("\nEvent id: %s: Status: %s (UKNOWN). Error: %s", ev.ID, status, err.Error())
+	return evs
+}
+
+func (es *EventStream) markModified(id string) {
+	if es.modified == nil {
+		es.modified = map[string]bool{}
+	}
+	es.modified[id] = true
+}
+
+// Verifies two things:
+// 1. Every event must have an attestation
+// 2. Attested times must follow the chain, see AttestationOrder
+func (es *EventStream) OTSVerify(ots Timestamper) *OTSReport {
+	report := &OTSReport{
+		Name:           es.Name,
+		PubKey:         es.PubKey,
+		Results:        []*OTSResult{},
+		TrustedHeaders: ots.HasTrustedHeaders(),
+		OK:             true,
+	}
+	order := newAttestationOrder(ots.AttestationSlack())
+	for i := range es.Log {
+		ev := &es.Log[i]
+		before := ev.GetExtraString("ots")
+		result := ots.VerifyEvent(ev)
+		// Verifying upgrades pending attestations, keep them
+		if ev.GetExtraString("ots") != before {
+			es.markModified(ev.ID)
 		}
-	} else {
-		if attested_time != nil {
-			fmt.Printf("\nEvent id: %s: Status: %s (%s)", ev.ID, status, attested_time)
-		} else {
-			fmt.Printf("\nEvent id: %s: Status: %s", ev.ID, status)
+		err := order.Check(ev, result.AttestedTime)
+		// Found when an upgrade completed its attestation or one before it
+		if msg, ok := es.OutOfOrder[ev.ID]; ok && err == nil {
+			err = errors.New(msg)
+		}
+		if err != nil {
+			result.NonMonotonic = true
+			result.Error = err.Error()
+			report.NonMonotonic++
+			report.OK = false
 		}
+		report.add(result)
 	}
+
+	return report
 }
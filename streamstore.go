@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Helpers shared by the StreamStore implementations
+
+// Builds a new owned event stream from a private key or a freshly generated one. The
+// derivation records where a given private key came from.
+func newEventStream(name string, priv_key string, generate bool, derivation *Derivation) *EventStream {
+	if priv_key == "" && !generate {
+		log.Panic("You need to provide a private key or generate one when creating an account.")
+	}
+	if priv_key != "" && generate {
+		log.Panic("You can't provide both a private key and generate one.")
+	}
+	key := ""
+	seed := ""
+	if priv_key != "" {
+		key = priv_key
+	}
+	if generate {
+		seed, key, _ = keyGen()
+		derivation = &Derivation{Path: seedPath(0)}
+	}
+	es := &EventStream{
+		Name:       name,
+		PrivKey:    key,
+		PubKey:     getPubKey(key),
+		Log:        []nostr.Event{},
+		Derivation: derivation,
+	}
+	if es.PubKey == "" {
+		log.Panic("Invalid private key.")
+	}
+	es.Print(false)
+	if generate {
+		fmt.Printf("\nSeed: %s \nPrivate key: %s\n", seed, key)
+	}
+
+	// Encrypt the key at rest unless the user explicitly chose not to
+	passphrase, err := readPassphrase("Passphrase to encrypt the private key (empty to store it in plaintext): ", true)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	if passphrase == "" {
+		fmt.Println("WARNING: the private key is stored in plaintext.")
+		return es
+	}
+	if err = es.EncryptPrivKey(passphrase); err != nil {
+		log.Panic(err.Error())
+	}
+
+	return es
+}
+
+// Follow a stream of a pubkey - we start at the genesis event (NULL). The relays are hints
+// where the stream is published, they are kept on the stream and used for the sync.
+func followEventStream(store StreamStore, n *Nostr, pubkey string, name string, relays []string) error {
+	if pubkey == "" {
+		return errors.New("follow pubkey is empty")
+	}
+	if name == "" {
+		return errors.New("name can't be empty")
+	}
+
+	es := &EventStream{
+		Name:    name,
+		PrivKey: "", // we don't own the stream, merely follow it
+		PubKey:  pubkey,
+		Log:     []nostr.Event{},
+	}
+	for _, url := range relays {
+		es.AddRelay(url)
+		if err := n.AddRelay(url); err != nil {
+			log.Printf("can't connect to relay hint %s: %v\n", url, err)
+		}
+	}
+	err := store.SaveEventStream(es)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Followed %s.\n", pubkey)
+
+	return nil
+}
+
+// Recreates an owned stream from its private key and syncs its events back from the relays
+func restoreEventStream(store StreamStore, ots Timestamper, name string, priv_key string, derivation *Derivation, relays []string) error {
+	pubkey := getPubKey(priv_key)
+	if existing, err := store.GetEventStream(pubkey); err == nil {
+		return fmt.Errorf("stream %s (%s) already exists", existing.Name, pubkey)
+	}
+	if len(relays) == 0 {
+		return errors.New("no relays to restore the stream from")
+	}
+
+	es := newEventStream(name, priv_key, false, derivation)
+	for _, url := range relays {
+		es.AddRelay(url)
+	}
+	err := store.SaveEventStream(es)
+	if err != nil {
+		return err
+	}
+	n := NewNostr(es.ListRelays())
+	if len(n.Pool) == 0 {
+		return errors.New("can't connect to any of the relays, run es sync later")
+	}
+	err = es.Sync(n, ots)
+	// Keep whatever we managed to sync even if a later event was invalid
+	store.SaveEventStream(es)
+
+	return err
+}
+
+// Copies every event stream and the active stream from one store to another
+func migrateStreams(from StreamStore, to StreamStore) error {
+	ess, err := from.GetAllEventStreams()
+	if err != nil {
+		return err
+	}
+	for _, es := range ess {
+		err = to.SaveEventStream(es)
+		if err != nil {
+			return fmt.Errorf("can't migrate stream %s: %w", es.Name, err)
+		}
+	}
+	active, err := from.GetActiveStream()
+	if err == nil {
+		return to.SetActiveEventStream(active.Name)
+	}
+
+	return nil
+}
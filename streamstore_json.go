@@ -19,6 +19,8 @@ const STATE_FILE = "state.json"
 // Very simple json storage
 type LocalDB struct {
 	state State
+	// Journals of the streams saved by this process keyed by pubkey
+	journals map[string]*StreamJournal
 }
 
 // Handles which event stream is active
@@ -47,15 +49,10 @@ func (s *State) Load() {
 func (s *State) Save() {
 	base_dir_exp, _ := homedir.Expand(STREAM_BASE_DIR)
 	path := filepath.Join(base_dir_exp, STATE_FILE)
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	err := writeJSONAtomic(path, 0644, *s)
 	if err != nil {
-		log.Fatal("can't open state file " + path + ": " + err.Error())
-		return
+		log.Fatal("can't write state file " + path + ": " + err.Error())
 	}
-
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	enc.Encode(*s)
 }
 
 func (s *State) GetActive() string {
@@ -69,29 +66,8 @@ func (s *State) SetActive(active string) {
 /// StreamStore interface implementation
 
 // Create a new event stream (or use an existing one)
-func (db *LocalDB) CreateEventStream(name string, priv_key string, generate bool) {
-	if priv_key == "" && !generate {
-		log.Panic("You need to provide a private key or generate one when creating an account.")
-	}
-	if priv_key != "" && generate {
-		log.Panic("You can't provide both a private key and generate one.")
-	}
-	key := ""
-	seed := ""
-	if priv_key != "" {
-		key = priv_key
-	}
-	if generate {
-		seed, key, _ = keyGen()
-	}
-	es := &EventStream{
-		Name:    name,
-		PrivKey: key,
-		PubKey:  getPubKey(key),
-		Log:     []nostr.Event{},
-	}
-	es.Print(false)
-	fmt.Printf("\nSeed: %s \nPrivate key: %s", seed, key)
+func (db *LocalDB) CreateEventStream(name string, priv_key string, generate bool, derivation *Derivation) {
+	es := newEventStream(name, priv_key, generate, derivation)
 
 	err := db.SaveEventStream(es)
 	if err != nil {
@@ -112,12 +88,15 @@ func (db *LocalDB) RemoveEventStream(name string) {
 		db.state.SetActive("")
 		db.state.Save()
 	}
-	// Delete stream file
+	// Delete stream file and its journal
 	path := pathForPubKey("stream", pubkey)
 	e := os.Remove(path)
 	if e != nil {
 		log.Fatal(e)
 	}
+	os.Remove(journalPathForPubKey(pubkey))
+	openEventLog(pubkey).Remove()
+	delete(db.journals, pubkey)
 }
 
 func (db *LocalDB) SetActiveEventStream(name string) error {
@@ -131,44 +110,162 @@ func (db *LocalDB) SetActiveEventStream(name string) error {
 	return nil
 }
 
-// Get the active account
+// Get the active account. Commands only need its key, name and relays, so its events are
+// not read.
 func (db *LocalDB) GetActiveStream() (*EventStream, error) {
 	pubkey := db.state.GetActive()
 	if pubkey == "" {
 		return nil, errors.New("no active stream set")
 	}
-	return db.GetEventStream(pubkey)
+	return db.getStreamMeta(pubkey)
+}
+
+// The content of a stream file. Events live in the stream's event log, the stream file only
+// records up to where the log was saved. Stream files written before the event log existed
+// have no checkpoint and hold the events in the log field.
+type streamFile struct {
+	EventStream
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+func loadStreamFile(pubkey string) (*streamFile, error) {
+	var sf streamFile
+	path := pathForPubKey("stream", pubkey)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&sf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sf, nil
 }
 
 // Get a specific event stream stored locally
 func (db *LocalDB) GetEventStream(pubkey string) (*EventStream, error) {
-	var es EventStream
-	path := pathForPubKey("stream", pubkey)
-	f, _ := os.Open(path)
-	err := json.NewDecoder(f).Decode(&es)
+	es, cp, err := db.loadStream(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	if es.Log == nil {
+		// The stream file is replaced only after the log is written, so the checkpoint also
+		// keeps out events another process is appending right now
+		es.Log, err = openEventLog(pubkey).ReadAll(cp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return es, nil
+}
+
+// Loads the stream without reading its event log. Its size, head and MMR come from the
+// checkpoint and the MMR peaks of the stream file. The log is nil unless the stream file is in
+// the old format.
+func (db *LocalDB) getStreamMeta(pubkey string) (*EventStream, error) {
+	es, cp, err := db.loadStream(pubkey)
+	if err != nil || es.Log != nil {
+		return es, err
+	}
+	if es.MMR == nil || es.MMR.Size != cp.Size {
+		// No peaks to answer from, the events are needed to rebuild them
+		es.Log, err = openEventLog(pubkey).ReadAll(cp)
+		if err != nil {
+			return nil, err
+		}
+		return es, nil
+	}
+	es.unloaded = cp
+
+	return es, nil
+}
+
+// Loads the stream metadata and the checkpoint of its event log
+func (db *LocalDB) loadStream(pubkey string) (*EventStream, *Checkpoint, error) {
+	sf, err := loadStreamFile(pubkey)
+	if err != nil {
+		// The stream file is missing or corrupted, try to rebuild it from the journal
+		recovered, rerr := db.recoverEventStream(pubkey)
+		if rerr != nil {
+			return nil, nil, err
+		}
+		log.Printf("stream file %s was unreadable (%s), recovered it from the journal", pathForPubKey("stream", pubkey), err.Error())
+		return recovered, nil, nil
+	}
+	es := sf.EventStream
+	if sf.Checkpoint != nil {
+		es.Log = nil
+	} else if es.Log == nil {
+		es.Log = []nostr.Event{}
+	}
+
+	return &es, sf.Checkpoint, nil
+}
+
+func (db *LocalDB) recoverEventStream(pubkey string) (*EventStream, error) {
+	j, err := db.getJournal(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	es, err := j.Recover()
+	if err != nil {
+		return nil, err
+	}
+	if es.PubKey != pubkey {
+		return nil, fmt.Errorf("journal pubkey %s doesn't match %s", es.PubKey, pubkey)
+	}
+	// Without the stream file there's no checkpoint, so the whole log is taken
+	es.Log, err = openEventLog(pubkey).ReadAll(nil)
+	if err != nil {
+		return nil, err
+	}
+	es.mmr()
+	err = db.SaveEventStream(es)
 	if err != nil {
 		return nil, err
 	}
-	f.Close()
 
-	return &es, nil
+	return es, nil
+}
+
+func (db *LocalDB) getJournal(pubkey string) (*StreamJournal, error) {
+	if j, ok := db.journals[pubkey]; ok && !j.IsStale() {
+		return j, nil
+	}
+	j, err := openJournal(journalPathForPubKey(pubkey))
+	if err != nil {
+		return nil, err
+	}
+	if db.journals == nil {
+		db.journals = map[string]*StreamJournal{}
+	}
+	db.journals[pubkey] = j
+
+	return j, nil
 }
 
 // Get all event streams stored locally
 func (db *LocalDB) GetAllEventStreams() ([]*EventStream, error) {
+	return db.walkStreams(db.GetEventStream)
+}
+
+// Calls load for every stream file in the streams folder
+func (db *LocalDB) walkStreams(load func(string) (*EventStream, error)) ([]*EventStream, error) {
 	base_path, _ := homedir.Expand(STREAM_BASE_DIR)
 	var result []*EventStream
 	filepath.Walk(base_path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Fatalf(err.Error())
 		}
-		splt := strings.Split(info.Name(), ".")
-		ext := splt[len(splt)-1]
-		if info.Name() == "streams" || info.Name() == STATE_FILE || ext == "ots" {
+		// Only stream files, skip the state, journals, event logs and temporary files
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".stream.json") {
 			return nil
 		}
 
-		es, err := db.GetEventStream(strings.Split(info.Name(), ".")[0])
+		es, err := load(strings.TrimSuffix(info.Name(), ".stream.json"))
 		if err != nil {
 			log.Fatalf(err.Error())
 		}
@@ -179,51 +276,91 @@ func (db *LocalDB) GetAllEventStreams() ([]*EventStream, error) {
 	return result, nil
 }
 
+// Saves the stream. The metadata changes are appended to the journal, the events that are
+// new since the last save are appended to the event log, the ones that changed to its patches
+// and finally the stream file with the new checkpoint atomically replaces the old one. The
+// journal is then compacted to its last record so it doesn't grow with every save.
 func (db *LocalDB) SaveEventStream(es *EventStream) error {
 	path := pathForPubKey("stream", es.PubKey)
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	j, err := db.getJournal(es.PubKey)
 	if err != nil {
-		log.Fatal("can't open stream file " + path + ": " + err.Error())
 		return err
 	}
+	if err = j.Write(es); err != nil {
+		return fmt.Errorf("can't write journal for %s: %w", es.Name, err)
+	}
 
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	enc.Encode(es)
-
-	return nil
-}
-
-// Follow a stream of a pubkey - we start at the genesis event (NULL)
-func (db *LocalDB) FollowEventStream(n *Nostr, ots Timestamper, pubkey string, name string) error {
-	if pubkey == "" {
-		return errors.New("follow pubkey is empty")
+	el := openEventLog(es.PubKey)
+	var cp *Checkpoint
+	sf, err := loadStreamFile(es.PubKey)
+	if es.unloaded != nil {
+		// Only the metadata changed, the event log stays as it is
+		if err != nil || sf.Checkpoint == nil {
+			return fmt.Errorf("can't save %s without its events", es.Name)
+		}
+		cp = sf.Checkpoint
+		es.MMR = sf.MMR
+	} else if err == nil && sf.Checkpoint != nil {
+		old := sf.Checkpoint
+		extends := old.Size <= es.Size() && (old.Size == 0 || es.Log[old.Size-1].ID == old.Head)
+		if extends {
+			cp, err = el.Append(*old, es.Log[old.Size:])
+			if err == nil {
+				// Events that changed in place go to the patches
+				cp, err = el.Patch(*cp, es.modifiedEvents(old.Size))
+			}
+			if err != nil {
+				log.Printf("%s, rewriting the event log of %s", err.Error(), es.Name)
+			}
+		}
 	}
-	if name == "" {
-		return errors.New("name can't be empty")
+	if es.unloaded == nil && (cp == nil || cp.NeedsCompaction()) {
+		cp, err = el.Rewrite(es.Log)
+		if err != nil {
+			return fmt.Errorf("can't write event log for %s: %w", es.Name, err)
+		}
 	}
 
-	es := &EventStream{
-		Name:    name,
-		PrivKey: "", // we don't own the stream, merely follow it
-		PubKey:  pubkey,
-		Log:     []nostr.Event{},
+	sf = &streamFile{EventStream: *streamMeta(es), Checkpoint: cp}
+	if err = writeJSONAtomic(path, 0600, sf); err != nil {
+		log.Fatal("can't write stream file " + path + ": " + err.Error())
+		return err
 	}
-	err := db.SaveEventStream(es)
-	if err != nil {
-		log.Panic(err.Error())
+	if err = j.Compact(); err != nil {
+		log.Println(err.Error())
 	}
-	fmt.Printf("Followed %s.\n", pubkey)
+	if es.unloaded != nil {
+		es.unloaded = cp
+	}
+	es.modified = nil
+
+	return nil
+}
 
-	// Sync the event stream
-	err = es.Sync(n, ots)
+// Finds an event in any of the locally stored streams
+func (db *LocalDB) FindEvent(id string) (*nostr.Event, error) {
+	ess, err := db.walkStreams(db.getStreamMeta)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for _, es := range ess {
+		// Streams in the old format have no event log yet
+		for _, ev := range es.Log {
+			if ev.ID == id {
+				return &ev, nil
+			}
+		}
+		if ev, err := openEventLog(es.PubKey).Lookup(id); err == nil {
+			return ev, nil
+		}
 	}
-	es.Print(false)
-	db.SaveEventStream(es)
 
-	return nil
+	return nil, fmt.Errorf("event %s is not stored locally", id)
+}
+
+// Follow a stream of a pubkey - we start at the genesis event (NULL)
+func (db *LocalDB) FollowEventStream(n *Nostr, pubkey string, name string, relays []string) error {
+	return followEventStream(db, n, pubkey, name, relays)
 }
 
 // Unfollow a stream with a given name - equivalent to remove stream
@@ -258,13 +395,14 @@ func (db *LocalDB) ListEventStreams(include_followed bool) error {
 
 // Returns two lists: owned and followed events streams
 func (db *LocalDB) GetOwnedFollowedESS() ([]*EventStream, []*EventStream) {
-	ess, err := db.GetAllEventStreams()
+	// Listing streams doesn't need their events
+	ess, err := db.walkStreams(db.getStreamMeta)
 	if err != nil {
 		log.Panic(err.Error())
 	}
 	owned := make([]*EventStream, 0)
 	for _, es := range ess {
-		if es.PrivKey != "" {
+		if es.IsOwned() {
 			owned = append(owned, es)
 		}
 	}
@@ -277,7 +415,7 @@ func (db *LocalDB) GetOwnedFollowedESS() ([]*EventStream, []*EventStream) {
 func (db *LocalDB) GetPubForName(name string) (string, error) {
 	found := false
 	rv := ""
-	ess, err := db.GetAllEventStreams()
+	ess, err := db.walkStreams(db.getStreamMeta)
 	if err != nil {
 		return "", err
 	}
@@ -298,6 +436,11 @@ func (db *LocalDB) GetPubForName(name string) (string, error) {
 
 /// Utils
 
+func journalPathForPubKey(pubkey string) string {
+	base_path, _ := homedir.Expand(STREAM_BASE_DIR)
+	return filepath.Join(base_path, pubkey) + ".stream.journal"
+}
+
 // Given a context (i.e. "account", "stream") returns path to file
 func pathForPubKey(ctx string, pubkey string) string {
 	base_path, _ := homedir.Expand(STREAM_BASE_DIR)
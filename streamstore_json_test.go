@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func testLocalDB(t *testing.T) *LocalDB {
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+	t.Setenv("HOME", t.TempDir())
+	base_path, _ := homedir.Expand(STREAM_BASE_DIR)
+	if err := os.MkdirAll(base_path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return &LocalDB{}
+}
+
+func TestLocalDBStreamLoadedWithoutEvents(t *testing.T) {
+	db := testLocalDB(t)
+	es := &EventStream{Name: "alice", PubKey: getPubKey(nostr.GeneratePrivateKey()), Relays: []string{}}
+	for _, content := range []string{"one", "two", "three"} {
+		es.Log = append(es.Log, *newTestEvent(t, content))
+	}
+	es.mmr()
+	if err := db.SaveEventStream(es); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := db.getStreamMeta(es.PubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Log != nil || meta.Size() != 3 || meta.GetHead() != es.GetHead() || meta.MMRRoot() != es.MMRRoot() {
+		t.Fatalf("loaded %d events, size %d, head %s", len(meta.Log), meta.Size(), meta.GetHead())
+	}
+	if err = meta.Append(*newTestEvent(t, "four"), nil); err == nil {
+		t.Fatal("appended to a stream loaded without its events")
+	}
+	// Saving it keeps the events
+	meta.Relays = append(meta.Relays, "wss://relay.example")
+	if err = db.SaveEventStream(meta); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := db.GetEventStream(es.PubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Size() != 3 || loaded.GetHead() != es.GetHead() || !reflect.DeepEqual(loaded.Relays, meta.Relays) {
+		t.Fatalf("saved as %d events, relays %v", loaded.Size(), loaded.Relays)
+	}
+
+	// An upgraded event is patched in
+	log_size := openEventLog(es.PubKey).size()
+	loaded.Log[0].SetExtra("ots", "upgraded")
+	loaded.markModified(loaded.Log[0].ID)
+	if err = db.SaveEventStream(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if openEventLog(es.PubKey).size() != log_size {
+		t.Fatal("saving an upgraded event rewrote the event log")
+	}
+	if loaded, _ = db.GetEventStream(es.PubKey); loaded.Log[0].GetExtraString("ots") != "upgraded" {
+		t.Fatal("the upgraded event wasn't saved")
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS state (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS streams (
+	pubkey  TEXT PRIMARY KEY,
+	name    TEXT NOT NULL,
+	privkey TEXT NOT NULL DEFAULT '',
+	meta    TEXT NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS streams_name ON streams(name);
+CREATE TABLE IF NOT EXISTS relays (
+	pubkey TEXT NOT NULL REFERENCES streams(pubkey) ON DELETE CASCADE,
+	url    TEXT NOT NULL,
+	PRIMARY KEY (pubkey, url)
+);
+CREATE TABLE IF NOT EXISTS events (
+	id     TEXT PRIMARY KEY,
+	pubkey TEXT NOT NULL REFERENCES streams(pubkey) ON DELETE CASCADE,
+	seq    INTEGER NOT NULL,
+	prev   TEXT NOT NULL,
+	raw    TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS events_pubkey_seq ON events(pubkey, seq);
+CREATE INDEX IF NOT EXISTS events_prev ON events(prev);
+CREATE TABLE IF NOT EXISTS tags (
+	event_id TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+	idx      INTEGER NOT NULL,
+	key      TEXT NOT NULL,
+	value    TEXT NOT NULL,
+	PRIMARY KEY (event_id, idx)
+);
+CREATE INDEX IF NOT EXISTS tags_key_value ON tags(key, value);
+`
+
+// Event streams stored in an embedded sqlite database
+type SQLiteDB struct {
+	db *sql.DB
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000&_secure_delete=on")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqliteSchema)
+	if err == nil {
+		// Databases created before the meta column existed
+		err = addColumnIfMissing(db, "streams", "meta", `TEXT NOT NULL DEFAULT '{}'`)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't initialize sqlite database %s: %w", path, err)
+	}
+
+	return &SQLiteDB{db: db}, nil
+}
+
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+
+	return err
+}
+
+func (s *SQLiteDB) getActive() string {
+	active := ""
+	err := s.db.QueryRow(`SELECT value FROM state WHERE key = 'active'`).Scan(&active)
+	if err != nil && err != sql.ErrNoRows {
+		log.Panic(err.Error())
+	}
+	return active
+}
+
+func (s *SQLiteDB) setActive(pubkey string) {
+	_, err := s.db.Exec(`INSERT INTO state (key, value) VALUES ('active', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, pubkey)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+}
+
+/// StreamStore interface implementation
+
+// Create a new event stream (or use an existing one)
+func (s *SQLiteDB) CreateEventStream(name string, priv_key string, generate bool, derivation *Derivation) {
+	es := newEventStream(name, priv_key, generate, derivation)
+
+	err := s.SaveEventStream(es)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+}
+
+func (s *SQLiteDB) RemoveEventStream(name string) {
+	pubkey, err := s.GetPubForName(name)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	// If deleted user was active, set nobody to active
+	if s.getActive() == pubkey {
+		s.setActive("")
+	}
+	_, err = s.db.Exec(`DELETE FROM streams WHERE pubkey = ?`, pubkey)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *SQLiteDB) SetActiveEventStream(name string) error {
+	pubkey, err := s.GetPubForName(name)
+	if err != nil {
+		return err
+	}
+	s.setActive(pubkey)
+
+	return nil
+}
+
+// Get the active account. Commands only need its key, name and relays, so its events are
+// not read.
+func (s *SQLiteDB) GetActiveStream() (*EventStream, error) {
+	pubkey := s.getActive()
+	if pubkey == "" {
+		return nil, errors.New("no active stream set")
+	}
+	es, err := s.getStreamMeta(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.loadRelays(es); err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{Head: GENESIS}
+	if err = s.db.QueryRow(`SELECT COUNT(*) FROM events WHERE pubkey = ?`, pubkey).Scan(&cp.Size); err != nil {
+		return nil, err
+	}
+	if es.MMR == nil || es.MMR.Size != cp.Size {
+		// No peaks to answer from, the events are needed to rebuild them
+		return s.GetEventStream(pubkey)
+	}
+	if cp.Size > 0 {
+		err = s.db.QueryRow(`SELECT id FROM events WHERE pubkey = ? AND seq = ?`, pubkey, cp.Size-1).Scan(&cp.Head)
+		if err != nil {
+			return nil, err
+		}
+	}
+	es.unloaded = cp
+
+	return es, nil
+}
+
+// Get a specific event stream stored in the database
+func (s *SQLiteDB) GetEventStream(pubkey string) (*EventStream, error) {
+	es, err := s.getStreamMeta(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.loadRelays(es); err != nil {
+		return nil, err
+	}
+	es.Log = []nostr.Event{}
+
+	evs, err := s.db.Query(`SELECT raw FROM events WHERE pubkey = ? ORDER BY seq`, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	defer evs.Close()
+	for evs.Next() {
+		var raw string
+		if err := evs.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var ev nostr.Event
+		if err := json.Unmarshal([]byte(raw), &ev); err != nil {
+			return nil, err
+		}
+		es.Log = append(es.Log, ev)
+	}
+
+	return es, evs.Err()
+}
+
+func (s *SQLiteDB) loadRelays(es *EventStream) error {
+	es.Relays = []string{}
+	rows, err := s.db.Query(`SELECT url FROM relays WHERE pubkey = ? ORDER BY rowid`, es.PubKey)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return err
+		}
+		es.Relays = append(es.Relays, url)
+	}
+
+	return rows.Err()
+}
+
+// Loads the stream without its relays and events
+func (s *SQLiteDB) getStreamMeta(pubkey string) (*EventStream, error) {
+	var name, priv_key, meta string
+	err := s.db.QueryRow(`SELECT name, privkey, meta FROM streams WHERE pubkey = ?`, pubkey).Scan(&name, &priv_key, &meta)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("could not find stream with pubkey: %s", pubkey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	es := EventStream{}
+	if err = json.Unmarshal([]byte(meta), &es); err != nil {
+		return nil, fmt.Errorf("can't parse metadata of stream %s: %w", pubkey, err)
+	}
+	es.Name = name
+	es.PrivKey = priv_key
+	es.PubKey = pubkey
+
+	return &es, nil
+}
+
+// Get all event streams stored in the database
+func (s *SQLiteDB) GetAllEventStreams() ([]*EventStream, error) {
+	pubkeys, err := s.listPubKeys(`SELECT pubkey FROM streams ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	var result []*EventStream
+	for _, pubkey := range pubkeys {
+		es, err := s.GetEventStream(pubkey)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, es)
+	}
+
+	return result, nil
+}
+
+// Finds an event in any of the stored streams
+func (s *SQLiteDB) FindEvent(id string) (*nostr.Event, error) {
+	var raw string
+	err := s.db.QueryRow(`SELECT raw FROM events WHERE id = ?`, id).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("event %s is not stored locally", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ev nostr.Event
+	if err = json.Unmarshal([]byte(raw), &ev); err != nil {
+		return nil, err
+	}
+
+	return &ev, nil
+}
+
+// Saves the stream metadata and relays. Only the events that are not in the database yet get
+// inserted unless the stored chain diverged from the log, in which case the events are rewritten.
+func (s *SQLiteDB) SaveEventStream(es *EventStream) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Fields that don't have their own column are stored as json in the meta column
+	meta := streamMeta(es)
+	meta.PrivKey = ""
+	meta.Relays = nil
+	meta_json, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO streams (pubkey, name, privkey, meta) VALUES (?, ?, ?, ?)
+		ON CONFLICT(pubkey) DO UPDATE SET name = excluded.name, privkey = excluded.privkey, meta = excluded.meta`,
+		es.PubKey, es.Name, es.PrivKey, string(meta_json))
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM relays WHERE pubkey = ?`, es.PubKey); err != nil {
+		return err
+	}
+	for _, url := range es.Relays {
+		if _, err = tx.Exec(`INSERT INTO relays (pubkey, url) VALUES (?, ?)`, es.PubKey, url); err != nil {
+			return err
+		}
+	}
+
+	if es.unloaded != nil {
+		// Only the metadata changed, the events stay as they are
+		return tx.Commit()
+	}
+
+	stored := 0
+	if err = tx.QueryRow(`SELECT COUNT(*) FROM events WHERE pubkey = ?`, es.PubKey).Scan(&stored); err != nil {
+		return err
+	}
+	if stored > 0 {
+		last_id := ""
+		err = tx.QueryRow(`SELECT id FROM events WHERE pubkey = ? AND seq = ?`, es.PubKey, stored-1).Scan(&last_id)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if stored > es.Size() || last_id != es.Log[stored-1].ID {
+			// The stored chain is not a prefix of the log
+			if _, err = tx.Exec(`DELETE FROM events WHERE pubkey = ?`, es.PubKey); err != nil {
+				return err
+			}
+			stored = 0
+		}
+	}
+	for seq := 0; seq < stored; seq++ {
+		if !es.modified[es.Log[seq].ID] {
+			continue
+		}
+		raw, err := json.Marshal(es.Log[seq])
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE events SET raw = ? WHERE id = ?`, string(raw), es.Log[seq].ID); err != nil {
+			return err
+		}
+	}
+	for seq := stored; seq < es.Size(); seq++ {
+		if err = insertEvent(tx, es.PubKey, seq, es.Log[seq]); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	es.modified = nil
+
+	return nil
+}
+
+func insertEvent(tx *sql.Tx, pubkey string, seq int, ev nostr.Event) error {
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO events (id, pubkey, seq, prev, raw) VALUES (?, ?, ?, ?, ?)`,
+		ev.ID, pubkey, seq, get_prev(ev), string(raw))
+	if err != nil {
+		return fmt.Errorf("can't insert event %s: %w", ev.ID, err)
+	}
+	for idx, tag := range ev.Tags {
+		_, err = tx.Exec(`INSERT INTO tags (event_id, idx, key, value) VALUES (?, ?, ?, ?)`,
+			ev.ID, idx, tag.Key(), tag.Value())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Follow a stream of a pubkey - we start at the genesis event (NULL)
+func (s *SQLiteDB) FollowEventStream(n *Nostr, pubkey string, name string, relays []string) error {
+	return followEventStream(s, n, pubkey, name, relays)
+}
+
+// Unfollow a stream with a given name - equivalent to remove stream
+func (s *SQLiteDB) UnfollowEventStream(name string) {
+	s.RemoveEventStream(name)
+}
+
+func (s *SQLiteDB) ListEventStreams(include_followed bool) error {
+	active := s.getActive()
+	if active == "" {
+		err := errors.New("no active stream set")
+		fmt.Println(err.Error())
+		return err
+	}
+	// Listing streams doesn't need their events
+	pubkeys, err := s.listPubKeys(`SELECT pubkey FROM streams ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	ess := []*EventStream{}
+	for _, pubkey := range pubkeys {
+		es, err := s.getStreamMeta(pubkey)
+		if err != nil {
+			return err
+		}
+		ess = append(ess, es)
+	}
+	for _, es := range ess {
+		if !es.IsOwned() {
+			continue
+		}
+		if es.PubKey == active {
+			fmt.Printf("* ")
+		}
+		es.Print(false)
+	}
+	if include_followed {
+		fmt.Printf("\n------------------------------------\n")
+		fmt.Printf("Following:")
+		fmt.Printf("\n------------------------------------\n")
+		for _, es := range ess {
+			es.Print(false)
+		}
+	}
+
+	return nil
+}
+
+// Returns a public key associated with the given name
+func (s *SQLiteDB) GetPubForName(name string) (string, error) {
+	pubkeys, err := s.listPubKeys(`SELECT pubkey FROM streams WHERE name = ?`, name)
+	if err != nil {
+		return "", err
+	}
+	if len(pubkeys) == 0 {
+		return "", fmt.Errorf("could not find stream with name: %s", name)
+	}
+	if len(pubkeys) > 1 {
+		return "", fmt.Errorf("name conflict for name: %s\npub1: %s\npub2: %s", name, pubkeys[0], pubkeys[1])
+	}
+	return pubkeys[0], nil
+}
+
+func (s *SQLiteDB) listPubKeys(query string, args ...any) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []string{}
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			return nil, err
+		}
+		result = append(result, pubkey)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const OTS_WATCH_FILE = "ots_watch.json"
+
+const (
+	DEFAULT_WATCH_INTERVAL = time.Minute
+	// Calendars commit to Bitcoin every few blocks, asking them more often is wasted
+	OTS_WATCH_MIN_BACKOFF = 10 * time.Minute
+	OTS_WATCH_MAX_BACKOFF = 6 * time.Hour
+)
+
+// When the watcher asks about a pending attestation next
+type watchEntry struct {
+	PubKey      string    `json:"pubkey"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// The schedule of pending attestations by event id. It's kept in the data directory so a
+// restarted watcher doesn't ask the calendars about everything at once.
+type OTSWatchSchedule struct {
+	path   string
+	Events map[string]*watchEntry `json:"events"`
+}
+
+func loadOTSWatchSchedule(dir string) (*OTSWatchSchedule, error) {
+	s := &OTSWatchSchedule{path: filepath.Join(dir, OTS_WATCH_FILE), Events: map[string]*watchEntry{}}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", s.path, err)
+	}
+	if s.Events == nil {
+		s.Events = map[string]*watchEntry{}
+	}
+
+	return s, nil
+}
+
+func (s *OTSWatchSchedule) Save() error {
+	return writeJSONAtomic(s.path, 0600, s)
+}
+
+// Whether the attestation of the event should be upgraded now. Events we see for the first
+// time are due right away.
+func (s *OTSWatchSchedule) due(id string, now time.Time) bool {
+	entry, ok := s.Events[id]
+	return !ok || !now.Before(entry.NextAttempt)
+}
+
+// Schedules the next attempt, waiting twice as long after every failed one
+func (s *OTSWatchSchedule) retry(id string, pubkey string, now time.Time, err error) {
+	entry, ok := s.Events[id]
+	if !ok {
+		entry = &watchEntry{PubKey: pubkey}
+		s.Events[id] = entry
+	}
+	entry.Attempts++
+	backoff := OTS_WATCH_MIN_BACKOFF
+	for i := 1; i < entry.Attempts && backoff < OTS_WATCH_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > OTS_WATCH_MAX_BACKOFF {
+		backoff = OTS_WATCH_MAX_BACKOFF
+	}
+	entry.NextAttempt = now.Add(backoff)
+	entry.LastError = ""
+	if err != ErrOTSPending && err != ErrOTSWaitingConfirmations {
+		entry.LastError = err.Error()
+	}
+}
+
+// Upgrades pending attestations of all the streams until interrupted
+func watchOTS(srv *StreamService, interval time.Duration) error {
+	srv.Lock()
+	schedule, err := loadOTSWatchSchedule(srv.config.DataDir)
+	srv.Unlock()
+	if err != nil {
+		return err
+	}
+
+	cancel_chan := make(chan os.Signal, 1)
+	signal.Notify(cancel_chan, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	fmt.Printf("Watching pending attestations every %s.\n", interval)
+	for {
+		srv.watchPass(schedule, time.Now())
+		select {
+		case <-ticker.C:
+		case sig := <-cancel_chan:
+			fmt.Println(sig)
+			fmt.Println("Stopped watching attestations.")
+			return nil
+		}
+	}
+}
+
+// Goes over the pending attestations of every stream once and upgrades the ones that are due.
+// The calendars are asked without holding the lock. The upgraded proofs are then saved under
+// the lock on top of each stream as it's stored by then, so we don't overwrite what other
+// commands saved meanwhile.
+func (s *StreamService) watchPass(schedule *OTSWatchSchedule, now time.Time) {
+	s.Lock()
+	ess, err := s.store.GetAllEventStreams()
+	s.Unlock()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	pending := map[string]bool{}
+	for _, es := range ess {
+		upgraded := map[string]string{}
+		attested := []string{}
+		for _, ev := range es.pendingAttestations(s.ots) {
+			pending[ev.ID] = true
+			if !schedule.due(ev.ID, now) {
+				continue
+			}
+			before := ev.GetExtraString("ots")
+			_, err := s.ots.Upgrade(ev)
+			if ev.GetExtraString("ots") != before {
+				upgraded[ev.ID] = ev.GetExtraString("ots")
+			}
+			if err != nil {
+				schedule.retry(ev.ID, es.PubKey, now, err)
+				continue
+			}
+			delete(schedule.Events, ev.ID)
+			delete(pending, ev.ID)
+			attested = append(attested, ev.ID)
+			log.Printf("Event %s of %s is attested in Bitcoin block %d", showEventID(ev.ID), es.Name, attestedHeight(ev))
+		}
+		if len(upgraded) == 0 {
+			continue
+		}
+		for _, id := range attested {
+			if ev, ok := es.getEvent(id); ok {
+				if err := es.recheckAttestationOrder(ev, s.ots); err != nil {
+					log.Printf("Stream %s: %s", es.Name, err.Error())
+				}
+			}
+		}
+		if err := s.saveAttestations(es.PubKey, upgraded, es.OutOfOrder); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	// Forget events that got upgraded elsewhere or were removed
+	for id := range schedule.Events {
+		if !pending[id] {
+			delete(schedule.Events, id)
+		}
+	}
+	if err := schedule.Save(); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Sets the upgraded proofs, by event id, on the stream as it's stored now and saves it along
+// with the events found out of order. Proofs another command already completed are kept.
+func (s *StreamService) saveAttestations(pubkey string, upgraded map[string]string, out_of_order map[string]string) error {
+	s.Lock()
+	defer s.Unlock()
+	es, err := s.store.GetEventStream(pubkey)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for id, msg := range out_of_order {
+		if _, ok := es.getEvent(id); !ok || es.OutOfOrder[id] == msg {
+			continue
+		}
+		if es.OutOfOrder == nil {
+			es.OutOfOrder = map[string]string{}
+		}
+		es.OutOfOrder[id] = msg
+		changed = true
+	}
+	for _, chain := range [][]nostr.Event{es.Log, es.Side} {
+		for i := range chain {
+			if ots, ok := upgraded[chain[i].ID]; ok && !s.ots.IsUpgraded(&chain[i]) {
+				chain[i].SetExtra("ots", ots)
+				es.markModified(chain[i].ID)
+			}
+		}
+	}
+	if len(es.modified) == 0 && !changed {
+		return nil
+	}
+
+	return s.store.SaveEventStream(es)
+}
+
+// Events of the stream, including side events, whose attestation isn't complete yet
+func (es *EventStream) pendingAttestations(ots Timestamper) []*nostr.Event {
+	evs := []*nostr.Event{}
+	for _, chain := range [][]nostr.Event{es.Log, es.Side} {
+		for i := range chain {
+			if !ots.IsUpgraded(&chain[i]) {
+				evs = append(evs, &chain[i])
+			}
+		}
+	}
+	return evs
+}
+
+// The lowest block height the attestation of the event commits to
+func attestedHeight(ev *nostr.Event) uint64 {
+	info, err := inspectOTS(ev)
+	if err != nil {
+		return 0
+	}
+	var height uint64
+	for _, att := range info.Of(ATTESTATION_BITCOIN) {
+		if height == 0 || att.Height < height {
+			height = att.Height
+		}
+	}
+	return height
+}
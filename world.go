@@ -27,10 +27,16 @@ func world(srv *StreamService, n *Nostr, event_streams []*EventStream, verbose b
 	}
 
 	// Before listening, we have to sync all event streams to their HEAD
-	sync_all(srv.store, n, srv.ots, ess_filtered)
+	sync_all(srv, n, ess_filtered)
+	// Events are signed by the current key of a stream which changes on key rotation
+	signers := map[string]string{}
 	var keys []string
 	for _, es := range ess_filtered {
-		keys = append(keys, es.PubKey)
+		if es.IsRevoked() {
+			continue
+		}
+		signers[es.SignerPubKey()] = es.PubKey
+		keys = append(keys, es.SignerPubKey())
 	}
 
 	// Find events for the streams we follow
@@ -46,7 +52,19 @@ L:
 	for {
 		select {
 		case ev := <-evt_chan:
-			handle_event(srv.store, srv.ots, ev)
+			pubkey, ok := signers[ev.PubKey]
+			if !ok {
+				continue
+			}
+			next := handle_event(srv, pubkey, ev)
+			// Listen for the successor key once a stream rotates its key
+			if next != ev.PubKey {
+				delete(signers, ev.PubKey)
+				if next != "" {
+					signers[next] = pubkey
+					n.Listen(&wg, ctx, evt_chan, nostr.Filter{Authors: []string{next}})
+				}
+			}
 		case sig := <-cancel_chan:
 			fmt.Println(sig)
 			// Shutdown threads
@@ -61,32 +79,54 @@ L:
 	fmt.Println("\nBye world.")
 }
 
-func sync_all(store StreamStore, n *Nostr, ots Timestamper, ess []*EventStream) {
+func sync_all(srv *StreamService, n *Nostr, ess []*EventStream) {
 	fmt.Println("Syncing event streams. This may take a while...")
 	for _, es := range ess {
-		es.Sync(n, ots)
-		store.SaveEventStream(es)
+		_, err := srv.UpdateStream(es.PubKey, func(es *EventStream) error {
+			return es.Sync(n, srv.ots)
+		})
+		if err != nil {
+			fmt.Printf("\n%s\n", err.Error())
+		}
 	}
 	fmt.Println("\nEvent streams synced.")
 }
 
-func handle_event(store StreamStore, ots Timestamper, ev nostr.Event) {
-	// Find the expected head of the event stream
-	es, err := store.GetEventStream(ev.PubKey)
-	if err != nil {
+// Appends the event to the stream of the pubkey and returns the key that signs the next
+// event of the stream. The key is empty once the stream is revoked.
+func handle_event(srv *StreamService, pubkey string, ev nostr.Event) string {
+	// Every relay sends us the same event
+	is_new, forks := false, 0
+	es, err := srv.UpdateStream(pubkey, func(es *EventStream) error {
+		if es.HasEvent(ev.ID) {
+			return nil
+		}
+		// Events that don't build on the head fork the stream
+		forks = len(es.Forks)
+		if err := es.Append(ev, srv.ots); err != nil {
+			return err
+		}
+		is_new = true
+		return nil
+	})
+	if es == nil {
 		log.Panic(err.Error())
 	}
-	expected_prev := es.GetHead()
-	prev := get_prev(ev)
-	if prev != expected_prev {
-		fmt.Printf("\nIgnoring event %s from %s.", ev.ID, es.Name)
-		fmt.Printf("\nExpected prev %s got %s.", expected_prev, prev)
-		fmt.Println()
+	if err != nil {
+		fmt.Printf("\nRejected event %s from %s: %s\n", ev.ID, es.Name, err.Error())
+		return es.SignerPubKey()
+	}
+	if !is_new {
+		return es.SignerPubKey()
 	}
-
-	// Append event to the event stream chain
-	es.Append(ev, ots)
-	store.SaveEventStream(es)
 
 	printEvent(ev, &es.Name, true)
+	if len(es.Forks) > forks {
+		fmt.Printf("\nFound a fork in %s at %s. See es forks %s.\n", es.Name, showEventID(get_prev(ev)), es.Name)
+	}
+	if es.IsRevoked() {
+		fmt.Printf("\nThe key of %s was revoked. The stream is closed.\n", es.Name)
+		return ""
+	}
+	return es.SignerPubKey()
 }